@@ -0,0 +1,59 @@
+// app
+package main
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type App struct {
+	sync.RWMutex
+	server *ReaderServer
+	config *Config
+	exit   chan bool
+}
+
+func NewApp(config *Config) *App {
+	store, err := NewStore(config.Store)
+	if err != nil {
+		log.Fatal("Cannot initialize store connection:", err)
+	}
+	log.Info("Store inited: ", config.Store.Driver)
+
+	index, err := NewIndex(config.Index)
+	if err != nil {
+		log.Fatal("Cannot initialize index connection:", err)
+	}
+	log.Info("Index inited: ", config.Index.Driver)
+
+	app := &App{
+		config: config,
+		server: NewReaderServer(config.Endpoint, index, store),
+		exit:   make(chan bool),
+	}
+	return app
+}
+
+func (app *App) Start() {
+	go app.server.Start()
+}
+
+func (app *App) Loop() {
+	app.RLock()
+	exitChan := app.exit
+	app.RUnlock()
+
+	if exitChan != nil {
+		<-app.exit
+	}
+}
+
+func (app *App) Shutdown(ctx context.Context) {
+	app.server.Shutdown(ctx)
+	if app.exit != nil {
+		close(app.exit)
+		app.exit = nil
+	}
+}
@@ -0,0 +1,57 @@
+// config
+package main
+
+import (
+	"github.com/sherifabdlnaby/configuro"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	Index    *IndexConfig
+	Store    *StoreConfig
+	Endpoint *EndpointConfig
+	General  *GeneralConfig
+}
+type EndpointConfig struct {
+	Port        int
+	Timeout     string // duration X[m,s,h]
+	Concurrency int    // store fetches in flight per render request, 16 by default
+}
+type StoreConfig struct {
+	Driver     string
+	Hosts      []string
+	Port       int
+	Resolution string
+	Keyspace   string
+	Username   string
+	Password   string
+	Table      string
+}
+type IndexConfig struct {
+	Driver    string
+	Addresses []string
+	Name      string
+	Password  string
+	Username  string
+	Insecure  bool
+	Region    string
+	Sigv4     bool
+	Limit     int // max paths returned by a single find
+}
+type GeneralConfig struct {
+	Level    string
+	Profiler bool
+}
+
+func PrepareConfig(configFile string) *Config {
+	Loader, err := configuro.NewConfig(configuro.WithLoadFromConfigFile(configFile, true))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := &Config{}
+	err = Loader.Load(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
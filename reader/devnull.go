@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type DevNull struct {
+	resolution int64
+}
+
+func (d *DevNull) Find(ctx context.Context, query string) ([]PathDoc, error) {
+	log.Debug("find:/dev/null: ", query)
+	return nil, nil
+}
+
+func (d *DevNull) Fetch(ctx context.Context, path string, from int64, until int64) ([]Point, error) {
+	log.Debug("fetch:/dev/null: ", path)
+	return nil, nil
+}
+
+func (d *DevNull) Resolution() int64 {
+	return d.resolution
+}
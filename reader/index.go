@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	opensearchapi "github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"github.com/opensearch-project/opensearch-go/v2/signer"
+	requestsigner "github.com/opensearch-project/opensearch-go/v2/signer/awsv2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type IIndex interface {
+	Find(ctx context.Context, query string) ([]PathDoc, error)
+}
+
+type OpensearchIndex struct {
+	config *IndexConfig
+	client *opensearch.Client
+}
+
+// PathDoc mirrors the document written by the writer's OpensearchIndex.add
+type PathDoc struct {
+	Path  string `json:"path"`
+	Leaf  bool   `json:"leaf"`
+	Depth int    `json:"depth"`
+}
+
+type searchResponse struct {
+	Hits struct {
+		Hits []struct {
+			Source PathDoc `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// characters with a special meaning in the Lucene regexp syntax
+const luceneReserved = `.?+*|{}[]()"\#@&<>~`
+
+func IsGlob(query string) bool {
+	return strings.ContainsAny(query, "*?[{")
+}
+
+// GlobToRegexp translates graphite glob (*, ?, [..], {a,b}) into a Lucene
+// regexp, wildcards never cross the segment boundary.
+func GlobToRegexp(glob string) string {
+	var sb strings.Builder
+	inBrace, inBracket := false, false
+	for _, r := range glob {
+		switch {
+		case inBracket:
+			if r == ']' {
+				inBracket = false
+			} else if r == '\\' || r == '"' {
+				sb.WriteRune('\\')
+			}
+			sb.WriteRune(r)
+		case r == '*':
+			sb.WriteString("[^.]*")
+		case r == '?':
+			sb.WriteString("[^.]")
+		case r == '[':
+			inBracket = true
+			sb.WriteRune(r)
+		case r == '{':
+			inBrace = true
+			sb.WriteRune('(')
+		case r == '}' && inBrace:
+			inBrace = false
+			sb.WriteRune(')')
+		case r == ',' && inBrace:
+			sb.WriteRune('|')
+		case strings.ContainsRune(luceneReserved, r):
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func (idx *OpensearchIndex) buildQuery(query string) map[string]interface{} {
+	var match map[string]interface{}
+	if IsGlob(query) {
+		match = map[string]interface{}{"regexp": map[string]interface{}{"path": map[string]interface{}{"value": GlobToRegexp(query)}}}
+	} else {
+		match = map[string]interface{}{"term": map[string]interface{}{"path": query}}
+	}
+	return map[string]interface{}{
+		"size":    idx.config.Limit,
+		"_source": []string{"path", "leaf", "depth"},
+		"sort":    []interface{}{map[string]interface{}{"path": "asc"}},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"depth": strings.Count(query, ".") + 1}},
+					match,
+				},
+			},
+		},
+	}
+}
+
+func (idx *OpensearchIndex) Find(ctx context.Context, query string) ([]PathDoc, error) {
+	body, err := json.Marshal(idx.buildQuery(query))
+	if err != nil {
+		return nil, err
+	}
+	search := opensearchapi.SearchRequest{Index: []string{idx.config.Name}, Body: bytes.NewReader(body)}
+	res, err := search.Do(ctx, idx.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("opensearch: %s", res.Status())
+	}
+
+	var sr searchResponse
+	if err := json.NewDecoder(res.Body).Decode(&sr); err != nil {
+		return nil, err
+	}
+	docs := make([]PathDoc, 0, len(sr.Hits.Hits))
+	for _, hit := range sr.Hits.Hits {
+		docs = append(docs, hit.Source)
+	}
+	return docs, nil
+}
+
+func NewOpenSearch(config *IndexConfig) (*opensearch.Client, error) {
+	ctx := context.Background()
+	var signer signer.Signer
+
+	if config.Sigv4 {
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithDefaultRegion(config.Region))
+		if err != nil {
+			return nil, err
+		}
+		signer, err = requestsigner.NewSignerWithService(awsCfg, "es")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tlsTransport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: bool(config.Insecure)},
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+
+	client, err := opensearch.NewClient(opensearch.Config{
+		Addresses: config.Addresses,
+		Signer:    signer,
+		Transport: tlsTransport,
+		Username:  config.Username,
+		Password:  config.Password,
+
+		RetryBackoff:         func(i int) time.Duration { return time.Duration(i) * 100 * time.Millisecond },
+		MaxRetries:           3,
+		EnableRetryOnTimeout: true,
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return client, nil
+}
+
+func NewOpensearchIndex(config *IndexConfig) (IIndex, error) {
+	if config.Limit < 1 {
+		config.Limit = 10000
+	}
+	client, err := NewOpenSearch(config)
+	if err != nil {
+		return nil, err
+	}
+	return &OpensearchIndex{config: config, client: client}, nil
+}
+
+func NewIndex(config *IndexConfig) (IIndex, error) {
+	switch config.Driver {
+	case "opensearch":
+		return NewOpensearchIndex(config)
+	default:
+		return &DevNull{}, nil
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob     string
+		expected string
+		matches  []string
+		misses   []string
+	}{
+		{"a.b", `a\.b`, []string{"a.b"}, []string{"axb"}},
+		{"a.*", `a\.[^.]*`, []string{"a.b", "a."}, []string{"a.b.c"}},
+		{"a.b?", `a\.b[^.]`, []string{"a.bc"}, []string{"a.b", "a.b."}},
+		{"a.[bc]d", `a\.[bc]d`, []string{"a.bd", "a.cd"}, []string{"a.dd"}},
+		{"a.{b,cd}", `a\.(b|cd)`, []string{"a.b", "a.cd"}, []string{"a.c"}},
+		{"a,b", `a,b`, []string{"a,b"}, nil},
+		{"a}b", `a\}b`, []string{"a}b"}, nil},
+		{`a+b"c`, `a\+b\"c`, []string{`a+b"c`}, []string{"aab\"c"}},
+		{`a.[\"]`, `a\.[\\\"]`, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.glob, func(t *testing.T) {
+			got := GlobToRegexp(test.glob)
+			if got != test.expected {
+				t.Fatalf("got %s, expected %s", got, test.expected)
+			}
+			// Lucene regexps are anchored, the escapes used are valid in Go too
+			re := regexp.MustCompile("^(?:" + got + ")$")
+			for _, path := range test.matches {
+				if !re.MatchString(path) {
+					t.Fatalf("%s does not match %s", got, path)
+				}
+			}
+			for _, path := range test.misses {
+				if re.MatchString(path) {
+					t.Fatalf("%s matches %s", got, path)
+				}
+			}
+		})
+	}
+}
+
+func TestIsGlob(t *testing.T) {
+	tests := map[string]bool{"a.b": false, "a.*": true, "a.b?": true, "a.[bc]": true, "a.{b,c}": true, "a,b": false}
+	for query, expected := range tests {
+		if IsGlob(query) != expected {
+			t.Fatalf("IsGlob(%q) is %v, expected %v", query, !expected, expected)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	// Set up config
+	var configFile string
+	flag.StringVar(&configFile, "c", "conf/config.yaml", "-c /etc/goshenite/reader.yaml")
+	flag.Parse()
+	config := PrepareConfig(configFile)
+
+	level, err := log.ParseLevel(config.General.Level)
+	if err != nil {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+
+	if config.General.Profiler {
+		go func() {
+			http.ListenAndServe(":9998", nil)
+		}()
+	}
+
+	app := NewApp(config)
+	app.Start()
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		for {
+			<-c
+			app.Shutdown(context.Background())
+			os.Exit(0)
+		}
+	}()
+
+	app.Loop()
+}
@@ -0,0 +1,119 @@
+// render
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RenderSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][2]interface{}  `json:"datapoints"`
+}
+
+var relativeUnits = map[string]int64{
+	"s": 1, "sec": 1, "secs": 1, "second": 1, "seconds": 1,
+	"min": 60, "mins": 60, "minute": 60, "minutes": 60,
+	"h": 3600, "hour": 3600, "hours": 3600,
+	"d": 86400, "day": 86400, "days": 86400,
+	"w": 604800, "week": 604800, "weeks": 604800,
+	"mon": 2592000, "month": 2592000, "months": 2592000,
+	"y": 31536000, "year": 31536000, "years": 31536000,
+}
+
+// ParseGraphiteTime understands the subset of graphite-web from/until formats
+// used by Grafana: "now", unix timestamps and relative offsets like "-1h" or "now-30min".
+func ParseGraphiteTime(s string, now time.Time) (int64, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "now")
+	if s == "" {
+		return now.Unix(), nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil && s[0] != '-' && s[0] != '+' {
+		return ts, nil
+	}
+	sign := int64(1)
+	switch s[0] {
+	case '-':
+		sign = -1
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	default:
+		return 0, errors.New("bad_time: " + s)
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 1 {
+		return 0, errors.New("bad_time: " + s)
+	}
+	n, _ := strconv.ParseInt(s[:i], 10, 64)
+	unit, ok := relativeUnits[s[i:]]
+	if !ok {
+		return 0, errors.New("bad_time_unit: " + s[i:])
+	}
+	return now.Unix() + sign*n*unit, nil
+}
+
+// AlignSeries spreads points over a regular [from, until] grid with the store
+// resolution as a step, gaps are filled with nulls just like graphite-web does.
+func AlignSeries(points []Point, from int64, until int64, step int64) (int64, []*float64) {
+	start := from - (from % step) + step
+	end := until - (until % step)
+	if end < start {
+		return start, nil
+	}
+	values := make([]*float64, (end-start)/step+1)
+	for i := range points {
+		p := points[i]
+		if p.Timestamp < start || p.Timestamp > end || math.IsNaN(p.Value) {
+			continue
+		}
+		values[(p.Timestamp-start)/step] = &p.Value
+	}
+	return start, values
+}
+
+// Consolidate averages consecutive values so the series fits into maxDataPoints.
+func Consolidate(values []*float64, step int64, maxDataPoints int) ([]*float64, int64) {
+	if maxDataPoints < 1 || len(values) <= maxDataPoints {
+		return values, step
+	}
+	perPoint := int(math.Ceil(float64(len(values)) / float64(maxDataPoints)))
+	result := make([]*float64, 0, maxDataPoints)
+	for i := 0; i < len(values); i += perPoint {
+		sum, count := 0.0, 0
+		for j := i; j < i+perPoint && j < len(values); j++ {
+			if values[j] != nil {
+				sum += *values[j]
+				count++
+			}
+		}
+		if count == 0 {
+			result = append(result, nil)
+			continue
+		}
+		avg := sum / float64(count)
+		result = append(result, &avg)
+	}
+	return result, step * int64(perPoint)
+}
+
+func NewRenderSeries(target string, start int64, step int64, values []*float64) RenderSeries {
+	series := RenderSeries{
+		Target:     target,
+		Tags:       map[string]string{"name": target},
+		Datapoints: make([][2]interface{}, len(values)),
+	}
+	for i, v := range values {
+		ts := start + int64(i)*step
+		if v == nil {
+			series.Datapoints[i] = [2]interface{}{nil, ts}
+		} else {
+			series.Datapoints[i] = [2]interface{}{*v, ts}
+		}
+	}
+	return series
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// values turns nils and floats into the []*float64 of a series
+func values(vs ...interface{}) []*float64 {
+	result := make([]*float64, len(vs))
+	for i, v := range vs {
+		if f, ok := v.(float64); ok {
+			result[i] = &f
+		}
+	}
+	return result
+}
+
+func equalValues(a, b []*float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if (a[i] == nil) != (b[i] == nil) || (a[i] != nil && *a[i] != *b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseGraphiteTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		input    string
+		expected int64
+		fails    bool
+	}{
+		{"", 1700000000, false},
+		{"now", 1700000000, false},
+		{" now ", 1700000000, false},
+		{"1600000000", 1600000000, false},
+		{"-1h", 1700000000 - 3600, false},
+		{"now-30min", 1700000000 - 1800, false},
+		{"-7d", 1700000000 - 7*86400, false},
+		{"now+2w", 1700000000 + 2*604800, false},
+		{"-1mon", 1700000000 - 2592000, false},
+		{"-10s", 1700000000 - 10, false},
+		{"-1y", 1700000000 - 31536000, false},
+		{"-h", 0, true},
+		{"-5fortnights", 0, true},
+		{"yesterday", 0, true},
+		{"now-", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			ts, err := ParseGraphiteTime(test.input, now)
+			if (err != nil) != test.fails {
+				t.Fatalf("got error %v", err)
+			}
+			if !test.fails && ts != test.expected {
+				t.Fatalf("got %d, expected %d", ts, test.expected)
+			}
+		})
+	}
+}
+
+func TestAlignSeries(t *testing.T) {
+	tests := []struct {
+		name     string
+		points   []Point
+		from     int64
+		until    int64
+		step     int64
+		start    int64
+		expected []*float64
+	}{
+		{"aligned", []Point{{70, 1}, {80, 2}, {90, 3}}, 60, 90, 10, 70, values(1.0, 2.0, 3.0)},
+		{"unaligned bounds", []Point{{70, 1}, {80, 2}}, 65, 95, 10, 70, values(1.0, 2.0, nil)},
+		{"gaps are nulls", []Point{{70, 1}, {90, 3}}, 60, 90, 10, 70, values(1.0, nil, 3.0)},
+		{"outside the range", []Point{{60, 0}, {70, 1}, {100, 4}}, 60, 90, 10, 70, values(1.0, nil, nil)},
+		{"NaN is a null", []Point{{70, math.NaN()}, {80, 2}}, 60, 80, 10, 70, values(nil, 2.0)},
+		{"empty range", []Point{{70, 1}}, 62, 68, 10, 70, nil},
+		{"no points", nil, 60, 80, 10, 70, values(nil, nil)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, got := AlignSeries(test.points, test.from, test.until, test.step)
+			if start != test.start || !equalValues(got, test.expected) {
+				t.Fatalf("got %d %v, expected %d %v", start, got, test.start, test.expected)
+			}
+		})
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		values        []*float64
+		maxDataPoints int
+		expected      []*float64
+		step          int64
+	}{
+		{"fits", values(1.0, 2.0, 3.0), 3, values(1.0, 2.0, 3.0), 10},
+		{"no limit", values(1.0, 2.0, 3.0), 0, values(1.0, 2.0, 3.0), 10},
+		{"averaged pairs", values(1.0, 3.0, 5.0, 7.0), 2, values(2.0, 6.0), 20},
+		{"uneven tail", values(1.0, 3.0, 5.0, 7.0, 9.0), 2, values(3.0, 8.0), 30},
+		{"nulls skipped", values(1.0, nil, nil, 4.0), 2, values(1.0, 4.0), 20},
+		{"all nulls", values(nil, nil, 2.0, 2.0), 2, values(nil, 2.0), 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, step := Consolidate(test.values, 10, test.maxDataPoints)
+			if step != test.step || !equalValues(got, test.expected) {
+				t.Fatalf("got %v with step %d, expected %v with step %d", got, step, test.expected, test.step)
+			}
+		})
+	}
+}
+
+func TestNewRenderSeries(t *testing.T) {
+	series := NewRenderSeries("a.b", 70, 10, values(1.0, nil))
+	expected := [][2]interface{}{{1.0, int64(70)}, {nil, int64(80)}}
+	if !reflect.DeepEqual(series.Datapoints, expected) {
+		t.Fatalf("got %v, expected %v", series.Datapoints, expected)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ReaderServer struct {
+	http    *http.Server
+	index   IIndex
+	store   IStore
+	timeout time.Duration
+	fetches int // per render request
+}
+
+type treeNode struct {
+	Text          string `json:"text"`
+	Id            string `json:"id"`
+	Leaf          int    `json:"leaf"`
+	Expandable    int    `json:"expandable"`
+	AllowChildren int    `json:"allowChildren"`
+}
+
+type completerNode struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	IsLeaf string `json:"is_leaf"`
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Failed writing response: ", err)
+	}
+}
+
+func (server *ReaderServer) find(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	if query == "" {
+		http.Error(w, "missing parameter: query", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), server.timeout)
+	defer cancel()
+
+	docs, err := server.index.Find(ctx, query)
+	if err != nil {
+		log.Error("Find failed: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("format") {
+	case "", "treejson":
+		nodes := make([]treeNode, 0, len(docs))
+		for _, doc := range docs {
+			nodes = append(nodes, treeNode{
+				Text:          doc.Path[strings.LastIndexByte(doc.Path, '.')+1:],
+				Id:            doc.Path,
+				Leaf:          boolToInt(doc.Leaf),
+				Expandable:    boolToInt(!doc.Leaf),
+				AllowChildren: boolToInt(!doc.Leaf),
+			})
+		}
+		writeJSON(w, nodes)
+	case "completer":
+		nodes := make([]completerNode, 0, len(docs))
+		for _, doc := range docs {
+			node := completerNode{Path: doc.Path, Name: doc.Path[strings.LastIndexByte(doc.Path, '.')+1:], IsLeaf: "1"}
+			if !doc.Leaf {
+				node.Path += "."
+				node.IsLeaf = "0"
+			}
+			nodes = append(nodes, node)
+		}
+		writeJSON(w, map[string]interface{}{"metrics": nodes})
+	default:
+		http.Error(w, "unsupported format: "+r.FormValue("format"), http.StatusBadRequest)
+	}
+}
+
+func (server *ReaderServer) render(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format := r.Form.Get("format"); format != "" && format != "json" {
+		http.Error(w, "unsupported format: "+format, http.StatusBadRequest)
+		return
+	}
+	targets := r.Form["target"]
+	if len(targets) == 0 {
+		http.Error(w, "missing parameter: target", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	fromParam, untilParam := r.Form.Get("from"), r.Form.Get("until")
+	if fromParam == "" {
+		fromParam = "-1d"
+	}
+	from, err := ParseGraphiteTime(fromParam, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := ParseGraphiteTime(untilParam, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxDataPoints, _ := strconv.Atoi(r.Form.Get("maxDataPoints"))
+
+	ctx, cancel := context.WithTimeout(r.Context(), server.timeout)
+	defer cancel()
+
+	var paths []string
+	for _, target := range targets {
+		if strings.ContainsAny(target, "()") {
+			http.Error(w, "functions are not supported: "+target, http.StatusBadRequest)
+			return
+		}
+		docs, err := server.index.Find(ctx, target)
+		if err != nil {
+			log.Error("Find failed: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, doc := range docs {
+			if doc.Leaf {
+				paths = append(paths, doc.Path)
+			}
+		}
+	}
+
+	step := server.store.Resolution()
+	result := make([]RenderSeries, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	// a wildcard can match thousands of leaves, fetches are bounded
+	sem := make(chan struct{}, server.fetches)
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			points, err := server.store.Fetch(ctx, path, from, until)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			start, values := AlignSeries(points, from, until, step)
+			values, seriesStep := Consolidate(values, step, maxDataPoints)
+			result[i] = NewRenderSeries(path, start, seriesStep, values)
+		}(i, path)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			log.Error("Fetch failed for ", paths[i], ": ", err)
+			http.Error(w, fmt.Sprintf("fetch %s: %s", paths[i], err), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (server *ReaderServer) Start() {
+	log.Info("Server started: listening on ", server.http.Addr)
+	err := server.http.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func (server *ReaderServer) Shutdown(ctx context.Context) {
+	log.Info("Shutting down server...")
+	server.http.Shutdown(ctx)
+}
+
+func NewReaderServer(config *EndpointConfig, index IIndex, store IStore) *ReaderServer {
+	server := &ReaderServer{
+		index:   index,
+		store:   store,
+		timeout: ParseDurationWithFallback(config.Timeout, 30*time.Second),
+		fetches: config.Concurrency,
+	}
+	if server.fetches < 1 {
+		server.fetches = 16
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/find", server.find)
+	mux.HandleFunc("/metrics/find/", server.find)
+	mux.HandleFunc("/render", server.render)
+	mux.HandleFunc("/render/", server.render)
+	server.http = &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: mux,
+	}
+	return server
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type Point struct {
+	Timestamp int64
+	Value     float64
+}
+
+type IStore interface {
+	Fetch(ctx context.Context, path string, from int64, until int64) ([]Point, error)
+	Resolution() int64
+}
+
+type CassandraStore struct {
+	session             *gocql.Session
+	cluster             *gocql.ClusterConfig
+	resolutionInSeconds int64
+	query               string
+}
+
+func (s *CassandraStore) Resolution() int64 {
+	return s.resolutionInSeconds
+}
+
+func (s *CassandraStore) Fetch(ctx context.Context, path string, from int64, until int64) ([]Point, error) {
+	var points []Point
+	var point Point
+	iter := s.session.Query(s.query, path, from, until).WithContext(ctx).Iter()
+	for iter.Scan(&point.Timestamp, &point.Value) {
+		points = append(points, point)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (s *CassandraStore) connect() error {
+	var err error
+	s.session, err = s.cluster.CreateSession()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func NewCassandraStore(config *StoreConfig) (IStore, error) {
+	res := int64(ParseDurationWithFallback(config.Resolution, time.Second*60).Seconds())
+	cluster := gocql.NewCluster()
+	cluster.Hosts = config.Hosts
+	cluster.Port = config.Port
+	cluster.Keyspace = config.Keyspace
+	if config.Password != "" && config.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: config.Username,
+			Password: config.Password,
+		}
+	}
+
+	cluster.RetryPolicy = &gocql.ExponentialBackoffRetryPolicy{NumRetries: 3, Min: 3, Max: 90}
+	store := &CassandraStore{
+		session:             nil,
+		cluster:             cluster,
+		query:               fmt.Sprintf(`SELECT timestamp, value FROM %s WHERE path=? AND timestamp>=? AND timestamp<=?`, config.Table),
+		resolutionInSeconds: res,
+	}
+
+	err := store.connect()
+	return store, err
+}
+
+func NewStore(config *StoreConfig) (IStore, error) {
+	switch config.Driver {
+	case "cassandra":
+		return NewCassandraStore(config)
+	default:
+		return &DevNull{resolution: int64(ParseDurationWithFallback(config.Resolution, time.Second*60).Seconds())}, nil
+	}
+}
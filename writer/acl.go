@@ -0,0 +1,134 @@
+// acl
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+type cidrList []*net.IPNet
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRList accepts networks as well as single addresses
+func parseCIDRList(entries []string) (cidrList, error) {
+	var list cidrList
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+// accessList is the allow/deny list of a listener, deny takes precedence and
+// an empty allow list allows everyone
+type accessList struct {
+	allow cidrList
+	deny  cidrList
+}
+
+// allowed checks the client IP, addresses without one (unix sockets) pass
+func (a *accessList) allowed(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+	if a.deny.contains(ip) {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow.contains(ip)
+}
+
+// newAccessList returns nil when there is nothing to check
+func newAccessList(allow, deny []string) (*accessList, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	var a accessList
+	var err error
+	if a.allow, err = parseCIDRList(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRList(deny); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// guardedListener applies the access list and connection limit to listeners
+// served by the standard library (tls, http), connections are closed right
+// after accept as gnet listeners do
+type guardedListener struct {
+	net.Listener
+	name  string
+	acl   *accessList
+	limit int64
+	open  int64 // atomic
+	stats *Stats
+}
+
+func (l *guardedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.acl.allowed(conn.RemoteAddr()) {
+			l.stats.Record(l.name, "rejected.acl")
+			conn.Close()
+			continue
+		}
+		if open := atomic.AddInt64(&l.open, 1); l.limit > 0 && open > l.limit {
+			atomic.AddInt64(&l.open, -1)
+			l.stats.Record(l.name, "rejected.limit")
+			conn.Close()
+			continue
+		}
+		return &guardedConn{Conn: conn, listener: l}, nil
+	}
+}
+
+// guardedConn gives its slot back once closed
+type guardedConn struct {
+	net.Conn
+	listener *guardedListener
+	closed   int32
+}
+
+func (c *guardedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.listener.open, -1)
+	}
+	return c.Conn.Close()
+}
+
+func newGuardedListener(listener net.Listener, name string, acl *accessList, limit int, stats *Stats) *guardedListener {
+	return &guardedListener{Listener: listener, name: name, acl: acl, limit: int64(limit), stats: stats}
+}
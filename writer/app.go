@@ -3,19 +3,17 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"sync"
 
 	"github.com/Pallinder/go-randomdata"
-	"github.com/panjf2000/gnet/v2"
 	log "github.com/sirupsen/logrus"
 )
 
 type App struct {
 	sync.RWMutex
 	bus      *Bus
-	server   *GosheniteServer
+	servers  []IServer
 	config   *Config
 	exit     chan bool
 	hostname string
@@ -44,14 +42,96 @@ func NewApp(config *Config) *App {
 
 	bus := NewBus(store, index, stats, config.Bus)
 
-	server := &GosheniteServer{
-		addr:  fmt.Sprintf("tcp://:%d", config.Endpoint.Port),
-		stats: stats,
-		bus:   bus,
+	endpoint := config.Endpoint
+	servers := []IServer{
+		NewGosheniteServer("tcp", "plain", "tcp", &endpoint.ListenerConfig, endpoint, stats, bus),
+	}
+	if endpoint.Pickle != nil {
+		servers = append(servers, NewGosheniteServer("pickle", "pickle", "tcp", endpoint.Pickle, endpoint, stats, bus))
+	}
+	if endpoint.Udp != nil {
+		servers = append(servers, NewGosheniteServer("udp", "plain", "udp", endpoint.Udp, endpoint, stats, bus))
+	}
+	if endpoint.Unix != nil {
+		server, err := NewUnixServer(endpoint.Unix, endpoint, stats, bus)
+		if err != nil {
+			log.Fatal("Cannot initialize unix socket listener:", err)
+		}
+		servers = append(servers, server)
+	}
+	if endpoint.Tls != nil {
+		server, err := NewTLSServer(endpoint.Tls, stats, bus)
+		if err != nil {
+			log.Fatal("Cannot initialize TLS listener:", err)
+		}
+		servers = append(servers, server)
+	}
+	if endpoint.Statsd != nil {
+		servers = append(servers, NewStatsdServer(endpoint.Statsd, endpoint, stats, bus))
+	}
+	if endpoint.Collectd != nil {
+		collectd, err := NewCollectdReceiver(endpoint.Collectd, stats, bus)
+		if err != nil {
+			log.Fatal("Cannot initialize collectd receiver:", err)
+		}
+		servers = append(servers, NewPacketServer("collectd", &endpoint.Collectd.ListenerConfig, endpoint, collectd.parsePacket, stats, bus))
+	}
+	var httpServer *HTTPServer
+	if endpoint.Http != nil {
+		httpServer = NewHTTPServer(endpoint.Http, stats, bus)
+		servers = append(servers, httpServer)
+	}
+	if endpoint.Prometheus != nil {
+		if httpServer == nil {
+			log.Fatal("Prometheus remote_write requires the http endpoint")
+		}
+		if _, err := NewPrometheusReceiver(endpoint.Prometheus, httpServer, stats, bus); err != nil {
+			log.Fatal("Cannot initialize prometheus receiver:", err)
+		}
+	}
+	if endpoint.Otlp != nil {
+		if httpServer == nil {
+			log.Fatal("OTLP receiver requires the http endpoint")
+		}
+		NewOTLPReceiver(endpoint.Otlp, httpServer, stats, bus)
+	}
+	if endpoint.Datadog != nil {
+		if httpServer == nil {
+			log.Fatal("Datadog intake requires the http endpoint")
+		}
+		NewDatadogReceiver(endpoint.Datadog, httpServer, stats, bus)
+	}
+	if endpoint.Influx != nil {
+		if httpServer == nil && endpoint.Influx.Port == 0 {
+			log.Fatal("InfluxDB receiver requires a port or the http endpoint")
+		}
+		influx, err := NewInfluxReceiver(endpoint.Influx, httpServer, stats, bus)
+		if err != nil {
+			log.Fatal("Cannot initialize influx receiver:", err)
+		}
+		if endpoint.Influx.Port > 0 {
+			servers = append(servers, NewLineServer("influx", "tcp", &endpoint.Influx.ListenerConfig, endpoint, influx.parseLines, stats, bus))
+		}
+	}
+	if endpoint.Opentsdb != nil {
+		if httpServer == nil && endpoint.Opentsdb.Port == 0 {
+			log.Fatal("OpenTSDB receiver requires a port or the http endpoint")
+		}
+		opentsdb := NewOpenTSDBReceiver(endpoint.Opentsdb, httpServer, stats, bus)
+		if endpoint.Opentsdb.Port > 0 {
+			servers = append(servers, NewLineServer("opentsdb", "tcp", &endpoint.Opentsdb.ListenerConfig, endpoint, opentsdb.parseLines, stats, bus))
+		}
+	}
+	if config.Scrape != nil {
+		scrape, err := NewScrapeManager(config.Scrape, stats, bus)
+		if err != nil {
+			log.Fatal("Cannot initialize scrape manager:", err)
+		}
+		servers = append(servers, scrape)
 	}
 	app := &App{
 		config:   config,
-		server:   server,
+		servers:  servers,
 		bus:      bus,
 		hostname: hostname,
 		exit:     make(chan bool),
@@ -63,16 +143,9 @@ func NewApp(config *Config) *App {
 func (app *App) Start() {
 	app.bus.Start()
 
-	go func() {
-		err := gnet.Run(
-			app.server, app.server.addr,
-			gnet.WithMulticore(app.config.Endpoint.Multicore),
-			gnet.WithReusePort(app.config.Endpoint.Reuseport),
-		)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
+	for _, server := range app.servers {
+		go server.Start()
+	}
 }
 
 func (app *App) Loop() {
@@ -85,7 +158,9 @@ func (app *App) Loop() {
 	}
 }
 func (app *App) Shutdown(ctx context.Context) {
-	app.server.Shutdown(ctx)
+	for _, server := range app.servers {
+		server.Shutdown(ctx)
+	}
 	app.bus.Drain(ctx)
 	if app.exit != nil {
 		close(app.exit)
@@ -2,18 +2,67 @@ package main
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"time"
 
-	lane "github.com/oleiade/lane/v2"
 	log "github.com/sirupsen/logrus"
 )
 
+// workers record their stats every that many datapoints, and whenever they
+// run out of work
+const busWorkerStatsBatch = 1024
+
+// busSource is what workers consume, queues in queued mode and the handoff
+// otherwise
+type busSource interface {
+	Dequeue() (*DataPoint, bool) // does not wait
+	Wait() (*DataPoint, bool)    // false once closed and empty
+	Close()
+}
+
+// handoff moves datapoints off the emitting goroutine (usually a gnet event
+// loop) in unqueued mode, nothing is dropped, emitters wait when it is full.
+type handoff struct {
+	items chan *DataPoint
+	done  chan struct{}
+}
+
+func (h *handoff) Dequeue() (*DataPoint, bool) {
+	select {
+	case datapoint := <-h.items:
+		return datapoint, true
+	default:
+		return nil, false
+	}
+}
+
+func (h *handoff) Wait() (*DataPoint, bool) {
+	select {
+	case datapoint := <-h.items:
+		return datapoint, true
+	case <-h.done:
+		return h.Dequeue()
+	}
+}
+
+// Close does not close items, late emitters (e.g. stats) must not panic
+func (h *handoff) Close() {
+	close(h.done)
+}
+
 type Bus struct {
 	config  *BusConfig
 	store   IStore
 	index   IIndex
-	queue   *lane.Queue[*DataPoint]
-	running bool
+	queues  []*busQueue // a single shared one unless sharded
+	handoff *handoff    // unqueued mode
+	spill   *spillLog   // while the store or index is failing
+	failed  *busQueue   // datapoints of failed bundles without a spill log
+	wg      sync.WaitGroup
+	retries sync.WaitGroup // retryFailed
+	done    chan struct{}
+	abort   chan struct{} // the drain deadline passed, retries give up
 	stats   *Stats
 }
 
@@ -21,67 +70,197 @@ func (b *Bus) Emit(datapoint *DataPoint) {
 	b.stats.RecordMetricIngestion(datapoint.Metric)
 	b.stats.Record("bus", "queue.added")
 	if b.config.Queued {
-		b.queue.Enqueue(datapoint)
+		queue := b.queue(datapoint.Metric)
+		dropped, waited := queue.Enqueue(datapoint)
+		if dropped != nil {
+			b.stats.Record("bus", "queue.dropped."+queue.policy)
+		}
+		if waited > 0 {
+			b.stats.Record("bus", "queue.blocked")
+			b.stats.Record("bus", "queue.blocked_ms", waited.Milliseconds())
+		}
 	} else {
-		b.put(datapoint)
+		b.handOff(datapoint)
 	}
 
 }
 
+// handOff waits only when all workers are busy and the handoff is full,
+// the waiting time is how long the emitting event loop was blocked
+func (b *Bus) handOff(datapoint *DataPoint) {
+	select {
+	case b.handoff.items <- datapoint:
+		return
+	default:
+	}
+	start := time.Now()
+	b.handoff.items <- datapoint
+	b.stats.Record("bus", "handoff.blocked")
+	b.stats.Record("bus", "handoff.blocked_us", time.Since(start).Microseconds())
+}
+
+// queue picks the queue by FNV-1a of the metric when sharded, so every
+// series is handled by a single worker in order
+func (b *Bus) queue(metric string) *busQueue {
+	if len(b.queues) == 1 {
+		return b.queues[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(metric); i++ {
+		h ^= uint32(metric[i])
+		h *= 16777619
+	}
+	return b.queues[h%uint32(len(b.queues))]
+}
+
+// Stop lets the workers finish what is queued and leave
 func (b *Bus) Stop() {
-	b.running = false
+	select {
+	case <-b.done:
+		return
+	default:
+		close(b.done)
+	}
+	for _, source := range b.sources() {
+		source.Close()
+	}
+}
+
+func (b *Bus) sources() []busSource {
+	if !b.config.Queued {
+		return []busSource{b.handoff}
+	}
+	sources := make([]busSource, len(b.queues))
+	for i, queue := range b.queues {
+		sources[i] = queue
+	}
+	return sources
 }
 
 func (b *Bus) Start() {
-	b.running = true
-	go b.run()
+	sources := b.sources()
+	for i := 0; i < b.config.Workers; i++ {
+		b.wg.Add(1)
+		go b.work(i, sources[i%len(sources)])
+	}
+	if b.spill != nil {
+		b.wg.Add(2)
+		go b.replay()
+		go func() {
+			defer b.wg.Done()
+			b.spill.run(b.done)
+		}()
+	}
+	if b.failed != nil {
+		b.retries.Add(1)
+		go b.retryFailed()
+	}
+	if b.config.Queued {
+		go b.monitor()
+		log.Info("Bus started: ", b.config.Workers, " workers, ", len(b.queues), " queues")
+	} else {
+		log.Info("Bus started: ", b.config.Workers, " workers, unqueued")
+	}
 	go b.stats.Start(b.Emit)
 }
 
+// Drain writes what is queued and the pending bundles, failing writes are
+// retried until ctx expires
 func (b *Bus) Drain(ctx context.Context) {
 	log.Info("Draining bus (metric queue)...")
-	drainedStats := false
-	if b.config.Queued {
-		for {
-			datapoint, ok := b.queue.Dequeue()
-			if !ok {
-				if drainedStats {
-					break
-				} else {
-					log.Info("Draining stats...")
-					b.stats.Drain()
-					drainedStats = true
-				}
-				continue
-			}
-			b.store.Insert(datapoint)
-			b.index.Index(datapoint)
-		}
+	log.Info("Draining stats...")
+	b.stats.Drain()
+	b.Stop()
+	b.wait(ctx, &b.wg)
+	// the final flush, failed bundles are requeued
+	b.store.Shutdown(ctx)
+	if b.failed != nil {
+		b.failed.Close()
+		b.wait(ctx, &b.retries)
+	}
+	if b.spill != nil {
+		b.spill.Close()
 	}
 	b.index.Shutdown(ctx)
 
 }
 
-func (b *Bus) run() {
-	log.Info("Bus started")
-	statsDumpTs := time.Now().Unix()
-	for b.running {
-		var datapoint *DataPoint
-		ok := false
-		if b.config.Queued {
-			datapoint, ok = b.queue.Dequeue()
-			curTs := time.Now().Unix()
-			if (curTs - statsDumpTs) > 59 {
-				b.stats.RecordFixed("bus", "queue.size", int64(b.queue.Size()))
-				statsDumpTs = curTs
-			}
+// wait returns once wg is done, when ctx expires first retries are aborted
+func (b *Bus) wait(ctx context.Context, wg *sync.WaitGroup) {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+	select {
+	case <-b.abort:
+	default:
+		log.Warn("Bus drain timed out, giving up failing writes")
+		close(b.abort)
+	}
+	<-finished
+}
+
+// work consumes a source until it is closed and empty, stats are recorded
+// in batches to keep the shared stats lock out of the way
+func (b *Bus) work(id int, source busSource) {
+	defer b.wg.Done()
+	unit := "bus.worker." + strconv.Itoa(id)
+	var processed, busy int64 // busy is time spent in store and index, in us
+	record := func() {
+		if processed == 0 {
+			return
 		}
+		b.stats.Record(unit, "processed", processed)
+		b.stats.Record(unit, "busy_us", busy)
+		b.stats.RecordFixed(unit, "latency_us", busy/processed)
+		b.stats.Record("bus", "queue.processed", processed)
+		processed, busy = 0, 0
+	}
+	for {
+		datapoint, ok := source.Dequeue()
 		if !ok {
-			time.Sleep(time.Second)
-			continue
+			record()
+			if datapoint, ok = source.Wait(); !ok {
+				return
+			}
+		}
+		start := time.Now()
+		switch {
+		case b.spill != nil:
+			b.putSpill(datapoint)
+		case b.config.Queued:
+			b.put(datapoint)
+		default:
+			b.putRetry(datapoint)
+		}
+		busy += time.Since(start).Microseconds()
+		processed++
+		if processed == busWorkerStatsBatch {
+			record()
+		}
+	}
+}
+
+func (b *Bus) monitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			size := uint(0)
+			for _, queue := range b.queues {
+				size += queue.Size()
+			}
+			b.stats.RecordFixed("bus", "queue.size", int64(size))
+		case <-b.done:
+			return
 		}
-		b.put(datapoint)
-		b.stats.Record("bus", "queue.processed")
 	}
 }
 
@@ -90,14 +269,195 @@ func (b *Bus) put(datapoint *DataPoint) {
 	b.index.Index(datapoint)
 }
 
+// write stores and indexes a datapoint, the first failure is returned.
+// Replayed datapoints are not bundled, the replay has to see failures.
+func (b *Bus) write(datapoint *DataPoint, replay bool) error {
+	insert := b.store.Insert
+	if batch, ok := b.store.(IBatchStore); ok && replay {
+		insert = batch.InsertNow
+	}
+	if err := insert(datapoint); err != nil {
+		return err
+	}
+	return b.index.Index(datapoint)
+}
+
+// putSpill appends to the spill log what fails, as well as everything
+// while it has a backlog, so series are written in order
+func (b *Bus) putSpill(datapoint *DataPoint) {
+	if !b.spill.pending() && b.write(datapoint, false) == nil {
+		return
+	}
+	b.spillFailed(datapoint)
+}
+
+func (b *Bus) spillFailed(datapoint *DataPoint) {
+	if err := b.spill.append(datapoint); err != nil {
+		log.Error("Cannot spill datapoint: ", err)
+		b.stats.Record("bus", "spill.errors")
+	}
+}
+
+// replay writes spilled datapoints back in order, each is retried with a
+// backoff until the store and index accept it, what is left when the bus
+// stops is replayed after a restart
+func (b *Bus) replay() {
+	defer b.wg.Done()
+	replayed := 0
+	for {
+		datapoint, ok := b.spill.peek()
+		if !ok {
+			if replayed > 0 {
+				b.spill.savePosition()
+				log.Info("Spill log replayed: ", replayed, " datapoints")
+				replayed = 0
+			}
+			select {
+			case <-b.spill.notify:
+				continue
+			case <-b.done:
+				return
+			}
+		}
+		backoff := 100 * time.Millisecond
+		for b.write(datapoint, true) != nil {
+			b.stats.Record("bus", "spill.retries")
+			select {
+			case <-time.After(backoff):
+			case <-b.done:
+				return
+			}
+			if backoff < 10*time.Second {
+				backoff *= 2
+			}
+		}
+		b.spill.commit()
+		b.stats.Record("bus", "spill.replayed")
+		if replayed++; replayed%spillSaveEvery == 0 {
+			b.spill.savePosition()
+		}
+	}
+}
+
+// putRetry is at-least-once, the store and then the index are retried with
+// a backoff until they accept the datapoint, it is given up only once the
+// drain deadline passed
+func (b *Bus) putRetry(datapoint *DataPoint) {
+	backoff := 100 * time.Millisecond
+	stored := false
+	for {
+		if !stored {
+			stored = b.store.Insert(datapoint) == nil
+		}
+		if stored {
+			if b.index.Index(datapoint) == nil {
+				return
+			}
+			b.stats.Record("bus", "handoff.index_retries")
+		} else {
+			b.stats.Record("bus", "handoff.retries")
+		}
+		select {
+		case <-time.After(backoff):
+		case <-b.abort:
+			b.stats.Record("bus", "handoff.lost")
+			return
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// requeue takes back datapoints of failed bundles when there is no spill
+// log, bundled Insert returns before the write so putRetry cannot see the
+// failure. It is called by the bundler and must not wait, retryFailed
+// writes them.
+func (b *Bus) requeue(datapoint *DataPoint) {
+	b.failed.Enqueue(datapoint)
+	b.stats.Record("bus", "handoff.requeued")
+}
+
+// retryFailed writes requeued datapoints one by one, each is retried with a
+// backoff until the drain deadline passes
+func (b *Bus) retryFailed() {
+	defer b.retries.Done()
+	batch := b.store.(IBatchStore)
+	for {
+		datapoint, ok := b.failed.Wait()
+		if !ok {
+			return
+		}
+		backoff := 100 * time.Millisecond
+		for batch.InsertNow(datapoint) != nil {
+			b.stats.Record("bus", "handoff.retries")
+			select {
+			case <-time.After(backoff):
+			case <-b.abort:
+				lost := int64(1)
+				for _, ok := b.failed.Dequeue(); ok; _, ok = b.failed.Dequeue() {
+					lost++
+				}
+				b.stats.Record("bus", "handoff.lost", lost)
+				return
+			}
+			if backoff < 10*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
+
 func NewBus(store IStore, index IIndex, stats *Stats, config *BusConfig) *Bus {
+	switch config.Overflow {
+	case "":
+		config.Overflow = OverflowDropNewest
+	case OverflowDropNewest, OverflowDropOldest, OverflowBlock:
+	default:
+		log.Warn("Unknown bus overflow policy ", config.Overflow, ", using ", OverflowDropNewest)
+		config.Overflow = OverflowDropNewest
+	}
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
 	bus := &Bus{
-		config:  config,
-		index:   index,
-		store:   store,
-		running: false,
-		stats:   stats,
-		queue:   lane.NewQueue[*DataPoint](),
+		config: config,
+		index:  index,
+		store:  store,
+		done:   make(chan struct{}),
+		abort:  make(chan struct{}),
+		stats:  stats,
+	}
+	if !config.Queued {
+		if config.Handoff < 1 {
+			config.Handoff = 1024
+		}
+		bus.handoff = &handoff{items: make(chan *DataPoint, config.Handoff), done: make(chan struct{})}
+	}
+	if config.Spill != nil && config.Spill.Dir != "" {
+		spill, err := newSpillLog(config.Spill, stats)
+		if err != nil {
+			log.Fatal("Cannot open spill log: ", err)
+		}
+		bus.spill = spill
+	}
+	// bundled writes fail after Insert returned
+	if batch, ok := store.(IBatchStore); ok {
+		if bus.spill != nil {
+			batch.OnFailure(bus.spillFailed)
+		} else {
+			bus.failed = newBusQueue(0, OverflowDropNewest)
+			batch.OnFailure(bus.requeue)
+		}
+	}
+	if config.Shard && config.Workers > 1 {
+		// the capacity is shared by all queues
+		capacity := (config.Capacity + config.Workers - 1) / config.Workers
+		for i := 0; i < config.Workers; i++ {
+			bus.queues = append(bus.queues, newBusQueue(capacity, config.Overflow))
+		}
+	} else {
+		bus.queues = []*busQueue{newBusQueue(config.Capacity, config.Overflow)}
 	}
 	return bus
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bundleStore bundles inserts until Shutdown, the final flush fails and
+// InsertNow fails a number of times before it accepts datapoints
+type bundleStore struct {
+	DevNull
+	sync.Mutex
+	bundle    []*DataPoint
+	onFailure func(datapoint *DataPoint)
+	failures  int // InsertNow calls left to fail, negative fails forever
+	written   map[string]float64
+}
+
+func (s *bundleStore) Insert(datapoint *DataPoint) error {
+	s.Lock()
+	defer s.Unlock()
+	s.bundle = append(s.bundle, datapoint)
+	return nil
+}
+
+func (s *bundleStore) InsertNow(datapoint *DataPoint) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.failures != 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	s.written[datapoint.Metric] = datapoint.Value
+	return nil
+}
+
+func (s *bundleStore) OnFailure(handler func(datapoint *DataPoint)) {
+	s.onFailure = handler
+}
+
+func (s *bundleStore) Shutdown(ctx context.Context) {
+	s.Lock()
+	bundle := s.bundle
+	s.bundle = nil
+	s.Unlock()
+	for _, datapoint := range bundle {
+		s.onFailure(datapoint)
+	}
+}
+
+func TestBusDrainRetriesFinalBundle(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		timeout  time.Duration
+		written  int
+		lost     int64
+	}{
+		{"accepted at once", 0, 5 * time.Second, 3, 0},
+		{"accepted after retries", 3, 5 * time.Second, 3, 0},
+		{"failing past the deadline", -1, 300 * time.Millisecond, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &bundleStore{failures: test.failures, written: make(map[string]float64)}
+			stats := NewStats(&StatsConfig{}, "test")
+			bus := NewBus(store, &DevNull{}, stats, &BusConfig{})
+			bus.Start()
+			for _, metric := range []string{"a.b", "a.c", "a.d"} {
+				bus.Emit(&DataPoint{Metric: metric, Value: 1, Timestamp: 1700000000})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			start := time.Now()
+			bus.Drain(ctx)
+			if elapsed := time.Since(start); elapsed > test.timeout+time.Second {
+				t.Fatalf("drain took %s", elapsed)
+			}
+			if len(store.written) != test.written {
+				t.Fatalf("got %d written, expected %d", len(store.written), test.written)
+			}
+			stats.RLock()
+			defer stats.RUnlock()
+			if lost := stats.metrics["bus.handoff.lost"]; lost != test.lost {
+				t.Fatalf("got %d lost, expected %d", lost, test.lost)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+// collectd
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultCollectdPort = 25826
+
+// collectd network protocol part types
+const (
+	collectdHost           = 0x0000
+	collectdTime           = 0x0001
+	collectdPlugin         = 0x0002
+	collectdPluginInstance = 0x0003
+	collectdType           = 0x0004
+	collectdTypeInstance   = 0x0005
+	collectdValues         = 0x0006
+	collectdTimeHR         = 0x0008
+	collectdSignature      = 0x0200
+	collectdEncryption     = 0x0210
+)
+
+// collectd data source types
+const (
+	collectdCounter  = 0
+	collectdGauge    = 1
+	collectdDerive   = 2
+	collectdAbsolute = 3
+)
+
+// security levels, values received below the configured level are dropped
+const (
+	collectdLevelNone = iota
+	collectdLevelSign
+	collectdLevelEncrypt
+)
+
+var (
+	errBadPart       = errors.New("bad_part")
+	errUnknownUser   = errors.New("unknown_user")
+	errBadSignature  = errors.New("bad_signature")
+	errBadEncryption = errors.New("bad_encryption")
+	errInsecure      = errors.New("insecure")
+)
+
+// collectdValueList is the state carried between parts of a packet
+type collectdValueList struct {
+	host           string
+	plugin         string
+	pluginInstance string
+	typ            string
+	typeInstance   string
+	time           int64
+}
+
+// LoadCollectdAuthFile reads `user: password` lines
+func LoadCollectdAuthFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		users[strings.TrimSpace(user)] = strings.TrimSpace(password)
+	}
+	return users, scanner.Err()
+}
+
+// LoadCollectdTypesDB reads data source names per type from types.db files,
+// e.g. `if_octets rx:DERIVE:0:U, tx:DERIVE:0:U`, missing files are skipped
+// and values of their types are named by index
+func LoadCollectdTypesDB(paths []string) (map[string][]string, error) {
+	types := make(map[string][]string)
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			log.Warn("collectd types.db not found, data sources are numbered: ", path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0][0] == '#' {
+				continue
+			}
+			var names []string
+			for _, ds := range strings.Split(strings.Join(fields[1:], ""), ",") {
+				if name, _, ok := strings.Cut(ds, ":"); ok {
+					names = append(names, name)
+				}
+			}
+			types[fields[0]] = names
+		}
+	}
+	return types, nil
+}
+
+// CollectdReceiver decodes the collectd binary network protocol, values end
+// up as `<prefix>.<host>.<plugin>[-<instance>].<type>[-<instance>][.<ds>]`
+type CollectdReceiver struct {
+	lineHandler
+
+	prefix  string
+	level   int
+	users   map[string]string
+	typesDB map[string][]string
+}
+
+// collectdString strips the terminating null byte of string parts
+func collectdString(payload []byte) string {
+	return string(bytes.TrimRight(payload, "\x00"))
+}
+
+func joinInstance(name, instance string) string {
+	if instance == "" {
+		return name
+	}
+	return name + "-" + instance
+}
+
+func (c *CollectdReceiver) emitValues(vl *collectdValueList, payload []byte) (int, error) {
+	if len(payload) < 2 {
+		return 0, errBadPart
+	}
+	count := int(binary.BigEndian.Uint16(payload))
+	if len(payload) != 2+count*9 {
+		return 0, errBadPart
+	}
+	kinds, values := payload[2:2+count], payload[2+count:]
+	names := c.typesDB[vl.typ]
+
+	path := c.prefix + SanitizeSegment(vl.host) + "." +
+		SanitizeSegment(joinInstance(vl.plugin, vl.pluginInstance)) + "." +
+		SanitizeSegment(joinInstance(vl.typ, vl.typeInstance))
+	emitted := 0
+	for i := 0; i < count; i++ {
+		raw := values[i*8 : i*8+8]
+		var value float64
+		switch kinds[i] {
+		case collectdCounter, collectdAbsolute:
+			value = float64(binary.BigEndian.Uint64(raw))
+		case collectdDerive:
+			value = float64(int64(binary.BigEndian.Uint64(raw)))
+		case collectdGauge:
+			// the only little endian field of the protocol
+			value = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		default:
+			return emitted, errBadPart
+		}
+		if math.IsNaN(value) {
+			continue
+		}
+		metric := path
+		if count > 1 {
+			if i < len(names) {
+				metric += "." + SanitizeSegment(names[i])
+			} else {
+				metric += "." + strconv.Itoa(i)
+			}
+		}
+		dp, err := NewDataPoint(metric, value, vl.time)
+		if err != nil {
+			return emitted, err
+		}
+		c.bus.Emit(&dp)
+		emitted++
+	}
+	return emitted, nil
+}
+
+// verifySignature checks HMAC-SHA256 of the username and everything after
+// the signature part
+func (c *CollectdReceiver) verifySignature(payload, rest []byte) error {
+	if len(payload) <= sha256.Size {
+		return errBadPart
+	}
+	signature, user := payload[:sha256.Size], payload[sha256.Size:]
+	password, ok := c.users[string(user)]
+	if !ok {
+		return errUnknownUser
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(user)
+	mac.Write(rest)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// decrypt returns the plain parts of an AES-256-OFB encrypted part, the key
+// is SHA-256 of the password and the plaintext is prefixed by its SHA-1.
+func (c *CollectdReceiver) decrypt(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errBadPart
+	}
+	userLen := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+userLen+aes.BlockSize+sha1.Size {
+		return nil, errBadPart
+	}
+	user := string(payload[2 : 2+userLen])
+	password, ok := c.users[user]
+	if !ok {
+		return nil, errUnknownUser
+	}
+	iv := payload[2+userLen : 2+userLen+aes.BlockSize]
+	encrypted := payload[2+userLen+aes.BlockSize:]
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewOFB(block, iv).XORKeyStream(plain, encrypted)
+
+	hash, parts := plain[:sha1.Size], plain[sha1.Size:]
+	sum := sha1.Sum(parts)
+	if !bytes.Equal(hash, sum[:]) {
+		return nil, errBadEncryption
+	}
+	return parts, nil
+}
+
+// parseParts returns the number of emitted values
+func (c *CollectdReceiver) parseParts(buf []byte, vl *collectdValueList, level int) (int, error) {
+	emitted := 0
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return emitted, errBadPart
+		}
+		typ := binary.BigEndian.Uint16(buf)
+		size := int(binary.BigEndian.Uint16(buf[2:]))
+		if size < 4 || size > len(buf) {
+			return emitted, errBadPart
+		}
+		payload, rest := buf[4:size], buf[size:]
+
+		switch typ {
+		case collectdHost:
+			vl.host = collectdString(payload)
+		case collectdPlugin:
+			vl.plugin = collectdString(payload)
+		case collectdPluginInstance:
+			vl.pluginInstance = collectdString(payload)
+		case collectdType:
+			vl.typ = collectdString(payload)
+		case collectdTypeInstance:
+			vl.typeInstance = collectdString(payload)
+		case collectdTime, collectdTimeHR:
+			if len(payload) != 8 {
+				return emitted, errBadPart
+			}
+			t := binary.BigEndian.Uint64(payload)
+			if typ == collectdTimeHR {
+				// 2^-30 seconds resolution
+				t >>= 30
+			}
+			vl.time = int64(t)
+		case collectdValues:
+			if level < c.level {
+				return emitted, errInsecure
+			}
+			n, err := c.emitValues(vl, payload)
+			emitted += n
+			if err != nil {
+				return emitted, err
+			}
+		case collectdSignature:
+			err := c.verifySignature(payload, rest)
+			if err == errUnknownUser && c.level == collectdLevelNone {
+				// nothing to verify against, same as an unsigned packet
+				break
+			}
+			if err != nil {
+				return emitted, err
+			}
+			n, err := c.parseParts(rest, vl, collectdLevelSign)
+			return emitted + n, err
+		case collectdEncryption:
+			parts, err := c.decrypt(payload)
+			if err != nil {
+				return emitted, err
+			}
+			n, err := c.parseParts(parts, vl, collectdLevelEncrypt)
+			emitted += n
+			if err != nil {
+				return emitted, err
+			}
+		}
+		// intervals, notifications and unknown parts are skipped
+		buf = rest
+	}
+	return emitted, nil
+}
+
+// parsePacket is the parser of the UDP listener, a malformed or
+// unauthenticated packet is counted as a single rejection
+func (c *CollectdReceiver) parsePacket(packet []byte, client net.Addr) (int, int) {
+	accepted, err := c.parseParts(packet, &collectdValueList{}, collectdLevelNone)
+	c.stats.Record(c.name, "values", int64(accepted))
+	if err != nil {
+		c.stats.Record("parser.errors", err.Error())
+		c.sampleParseError(nil, err, client)
+		return accepted, 1
+	}
+	return accepted, 0
+}
+
+func NewCollectdReceiver(config *CollectdConfig, stats *Stats, bus *Bus) (*CollectdReceiver, error) {
+	if config.Port == 0 {
+		config.Port = DefaultCollectdPort
+	}
+	if config.Prefix == "" {
+		config.Prefix = "collectd"
+	}
+	c := &CollectdReceiver{
+		lineHandler: newLineHandler("collectd", &config.ListenerConfig, stats, bus),
+		prefix:      config.Prefix + ".",
+		users:       make(map[string]string),
+	}
+	switch config.Security {
+	case "", "none":
+		c.level = collectdLevelNone
+	case "sign":
+		c.level = collectdLevelSign
+	case "encrypt":
+		c.level = collectdLevelEncrypt
+	default:
+		return nil, errors.New("unknown collectd security level " + config.Security)
+	}
+	if config.AuthFile != "" {
+		users, err := LoadCollectdAuthFile(config.AuthFile)
+		switch {
+		case err == nil:
+			c.users = users
+		case c.level != collectdLevelNone:
+			return nil, err
+		default:
+			log.Warn("Cannot load collectd auth file, signed and encrypted packets are dropped: ", err)
+		}
+	} else if c.level != collectdLevelNone {
+		return nil, errors.New("collectd security level " + config.Security + " requires an auth file")
+	}
+	typesDB, err := LoadCollectdTypesDB(config.TypesDB)
+	if err != nil {
+		return nil, err
+	}
+	c.typesDB = typesDB
+	log.Info("collectd receiver security level ", config.Security, ", ", len(c.users), " users")
+	return c, nil
+}
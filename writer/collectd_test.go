@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func collectdPart(typ uint16, payload []byte) []byte {
+	part := binary.BigEndian.AppendUint16(nil, typ)
+	part = binary.BigEndian.AppendUint16(part, uint16(4+len(payload)))
+	return append(part, payload...)
+}
+
+func collectdStringPart(typ uint16, s string) []byte {
+	return collectdPart(typ, append([]byte(s), 0))
+}
+
+func collectdGauges(values ...float64) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for range values {
+		payload = append(payload, collectdGauge)
+	}
+	for _, value := range values {
+		payload = binary.LittleEndian.AppendUint64(payload, math.Float64bits(value))
+	}
+	return collectdPart(collectdValues, payload)
+}
+
+// collectdPacket is a value list of host h, plugin cpu-0 and the given type
+func collectdPacket(typ string, values ...float64) []byte {
+	var packet []byte
+	packet = append(packet, collectdStringPart(collectdHost, "h")...)
+	packet = append(packet, collectdPart(collectdTime, binary.BigEndian.AppendUint64(nil, 1700000000))...)
+	packet = append(packet, collectdStringPart(collectdPlugin, "cpu")...)
+	packet = append(packet, collectdStringPart(collectdPluginInstance, "0")...)
+	packet = append(packet, collectdStringPart(collectdType, typ)...)
+	return append(packet, collectdGauges(values...)...)
+}
+
+func collectdSign(parts []byte, user, password string) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(user))
+	mac.Write(parts)
+	payload := append(mac.Sum(nil), user...)
+	return append(collectdPart(collectdSignature, payload), parts...)
+}
+
+func collectdEncrypt(parts []byte, user, password string) []byte {
+	sum := sha1.Sum(parts)
+	plain := append(sum[:], parts...)
+	key := sha256.Sum256([]byte(password))
+	block, _ := aes.NewCipher(key[:])
+	iv := make([]byte, aes.BlockSize)
+	for i := range iv {
+		iv[i] = byte(i)
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, plain)
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(user)))
+	payload = append(payload, user...)
+	payload = append(payload, iv...)
+	return collectdPart(collectdEncryption, append(payload, encrypted...))
+}
+
+func TestCollectdSecurity(t *testing.T) {
+	dir := t.TempDir()
+	authFile := filepath.Join(dir, "auth")
+	typesDB := filepath.Join(dir, "types.db")
+	if err := os.WriteFile(authFile, []byte("# users\nalice: secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(typesDB, []byte("if_octets rx:DERIVE:0:U, tx:DERIVE:0:U\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gauge := collectdPacket("gauge", 1.5)
+	tampered := collectdSign(gauge, "alice", "secret")
+	tampered[len(tampered)-1] ^= 0xff
+	truncated := collectdEncrypt(gauge, "alice", "secret")
+	truncated = collectdPart(collectdEncryption, truncated[4:4+2+5+aes.BlockSize])
+
+	tests := []struct {
+		name     string
+		security string
+		packet   []byte
+		expected map[string]float64
+		err      error
+	}{
+		{"plain", "none", gauge, map[string]float64{"collectd.h.cpu-0.gauge": 1.5}, nil},
+		{"types.db names", "none", collectdPacket("if_octets", 1, 2), map[string]float64{
+			"collectd.h.cpu-0.if_octets.rx": 1, "collectd.h.cpu-0.if_octets.tx": 2}, nil},
+		{"numbered data sources", "none", collectdPacket("load", 1, 2), map[string]float64{
+			"collectd.h.cpu-0.load.0": 1, "collectd.h.cpu-0.load.1": 2}, nil},
+		{"signed", "none", collectdSign(gauge, "alice", "secret"), map[string]float64{"collectd.h.cpu-0.gauge": 1.5}, nil},
+		{"signed by unknown user", "none", collectdSign(gauge, "bob", "x"), map[string]float64{"collectd.h.cpu-0.gauge": 1.5}, nil},
+		{"plain below sign", "sign", gauge, nil, errInsecure},
+		{"signed at sign", "sign", collectdSign(gauge, "alice", "secret"), map[string]float64{"collectd.h.cpu-0.gauge": 1.5}, nil},
+		{"bad signature", "sign", collectdSign(gauge, "alice", "wrong"), nil, errBadSignature},
+		{"tampered", "sign", tampered, nil, errBadSignature},
+		{"signed by unknown user at sign", "sign", collectdSign(gauge, "bob", "x"), nil, errUnknownUser},
+		{"encrypted at sign", "sign", collectdEncrypt(gauge, "alice", "secret"), map[string]float64{"collectd.h.cpu-0.gauge": 1.5}, nil},
+		{"signed below encrypt", "encrypt", collectdSign(gauge, "alice", "secret"), nil, errInsecure},
+		{"encrypted", "encrypt", collectdEncrypt(gauge, "alice", "secret"), map[string]float64{"collectd.h.cpu-0.gauge": 1.5}, nil},
+		{"wrong key", "encrypt", collectdEncrypt(gauge, "alice", "wrong"), nil, errBadEncryption},
+		{"encrypted by unknown user", "encrypt", collectdEncrypt(gauge, "bob", "secret"), nil, errUnknownUser},
+		{"truncated encryption", "encrypt", truncated, nil, errBadPart},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus, drain := newRecordBus()
+			config := &CollectdConfig{Security: test.security, AuthFile: authFile, TypesDB: []string{typesDB}}
+			c, err := NewCollectdReceiver(config, NewStats(&StatsConfig{}, "test"), bus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			emitted, err := c.parseParts(test.packet, &collectdValueList{}, collectdLevelNone)
+			values := drain()
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if emitted != len(test.expected) {
+				t.Fatalf("got %d values, expected %d", emitted, len(test.expected))
+			}
+			if len(test.expected) > 0 && !reflect.DeepEqual(values, test.expected) {
+				t.Fatalf("got %v, expected %v", values, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewCollectdReceiverConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	tests := []struct {
+		name   string
+		config CollectdConfig
+		fails  bool
+	}{
+		{"defaults", CollectdConfig{}, false},
+		{"missing files without security", CollectdConfig{AuthFile: missing, TypesDB: []string{missing}}, false},
+		{"sign without auth file", CollectdConfig{Security: "sign"}, true},
+		{"encrypt with a missing auth file", CollectdConfig{Security: "encrypt", AuthFile: missing}, true},
+		{"unknown security", CollectdConfig{Security: "paranoid"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewCollectdReceiver(&test.config, NewStats(&StatsConfig{}, "test"), nil)
+			if (err != nil) != test.fails {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
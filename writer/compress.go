@@ -0,0 +1,218 @@
+// compress
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// chunks a connection may be ahead of its decompressing goroutine, further
+// reads stay in the gnet inbound buffer until it caught up
+const compressedChunkQueue = 64
+
+// DefaultCompressedBacklog is the inbound buffer size of a connection that
+// is waiting for its decompressing goroutine, it is closed beyond
+const DefaultCompressedBacklog = 64 * 1024 * 1024
+
+var (
+	errUnknownCompression = errors.New("unknown compression")
+	errStreamStopped      = errors.New("stream stopped")
+	errStreamBehind       = errors.New("stream behind")
+)
+
+// checkCompression validates the codec of a stream listener
+func checkCompression(codec string) error {
+	switch codec {
+	case "", "none", "gzip", "snappy", "lz4":
+		return nil
+	}
+	return errUnknownCompression
+}
+
+// newDecompressor wraps r with a streaming decoder, gzip members are read
+// as one stream, snappy uses the framing format (the block format cannot be
+// streamed) and lz4 the frame format.
+func newDecompressor(codec string, r io.Reader) (io.Reader, error) {
+	switch codec {
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case "snappy":
+		return snappy.NewReader(r), nil
+	case "lz4":
+		return lz4.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// streamReader counts the compressed bytes and keeps transport errors apart
+// from decompression ones
+type streamReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// recordCompression accounts bytes read off the wire and bytes decoded from
+// them, the ratio (in percent) covers the listener lifetime
+func (h *lineHandler) recordCompression(in int64, out int) {
+	compressed := atomic.AddInt64(&h.compressedBytes, in)
+	decompressed := atomic.AddInt64(&h.decompressedBytes, int64(out))
+	h.stats.Record(h.name, "compression.in", in)
+	h.stats.Record(h.name, "compression.out", int64(out))
+	if compressed > 0 {
+		h.stats.RecordFixed(h.name, "compression.ratio", decompressed*100/compressed)
+	}
+}
+
+// readStream hands complete lines of a possibly compressed stream to parse
+// until it ends. A decoder reaching its end before the stream does (e.g. the
+// sender started a new lz4 frame) is replaced by a fresh one. Transport
+// errors end the stream silently, a decompression error is returned.
+func (h *lineHandler) readStream(r io.Reader, config *ListenerConfig, parse LineParser, client net.Addr) error {
+	source := &streamReader{r: r}
+	state := &connState{}
+	buf := make([]byte, GnetReadBufferCap(config.Buffer))
+	compressed := config.Compression != "" && config.Compression != "none"
+	reported := int64(0)
+
+	var err error
+	for err == nil {
+		var reader io.Reader
+		if reader, err = newDecompressor(config.Compression, source); err != nil {
+			break
+		}
+		for {
+			n, rerr := reader.Read(buf)
+			if n > 0 {
+				ok := state.feed(buf[:n], config.MaxLineLength, func(lines []byte) {
+					parse(lines, client)
+				})
+				if !ok {
+					h.stats.Record("parser.errors", "line_too_long")
+				}
+				if compressed {
+					h.recordCompression(source.n-reported, n)
+					reported = source.n
+				}
+			}
+			if rerr != nil {
+				err = rerr
+				break
+			}
+		}
+		if err == io.EOF && source.err == nil {
+			err = nil
+		}
+	}
+	if lines := state.flush(); lines != nil {
+		parse(lines, client)
+	}
+
+	if err == source.err {
+		return nil
+	}
+	// a stream cut in the middle of a frame ends up here as well
+	h.stats.Record(h.name, "compression.errors")
+	log.WithFields(log.Fields{
+		"listener": h.name,
+		"client":   client,
+		"codec":    config.Compression,
+	}).Warn("Cannot decompress stream: ", err)
+	return err
+}
+
+// chunkStream carries bytes read by the gnet event loop to the goroutine
+// decompressing the connection, decoders pull their input.
+type chunkStream struct {
+	chunks  chan []byte
+	current []byte
+	tail    []byte // unread when the connection closed, after the chunks
+	wake    func() // has the event loop push again
+	behind  int32  // a push was refused, the connection waits for wake
+	stopped int32  // the goroutine gave up reading, chunks are discarded
+}
+
+func newChunkStream(wake func()) *chunkStream {
+	return &chunkStream{chunks: make(chan []byte, compressedChunkQueue), wake: wake}
+}
+
+// push is called by the event loop and never waits, it fails once the
+// stream is broken. errStreamBehind leaves buf to the caller, the stream
+// wakes it once the queued chunks are read.
+func (s *chunkStream) push(buf []byte) error {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		return errStreamStopped
+	}
+	if atomic.LoadInt32(&s.behind) == 1 {
+		return errStreamBehind
+	}
+	// gnet reuses buf
+	chunk := append([]byte(nil), buf...)
+	select {
+	case s.chunks <- chunk:
+		return nil
+	default:
+	}
+	// set before trying again, Read cannot drain the queue unnoticed
+	atomic.StoreInt32(&s.behind, 1)
+	select {
+	case s.chunks <- chunk:
+		return nil
+	default:
+		return errStreamBehind
+	}
+}
+
+func (s *chunkStream) Read(p []byte) (int, error) {
+	for len(s.current) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			if len(s.tail) == 0 {
+				return 0, io.EOF
+			}
+			chunk, s.tail = s.tail, nil
+		}
+		if ok && len(s.chunks) == 0 && atomic.CompareAndSwapInt32(&s.behind, 1, 0) {
+			s.wake()
+		}
+		s.current = chunk
+	}
+	n := copy(p, s.current)
+	s.current = s.current[n:]
+	return n, nil
+}
+
+// close is called by the event loop when the connection is gone, tail is
+// what it could not push yet
+func (s *chunkStream) close(tail []byte) {
+	s.tail = append([]byte(nil), tail...)
+	close(s.chunks)
+}
+
+// stop discards what is still pushed until the connection is closed, so
+// the event loop never waits on a goroutine that is not reading anymore
+func (s *chunkStream) stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+	for range s.chunks {
+	}
+}
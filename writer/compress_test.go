@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChunkStreamBackpressure(t *testing.T) {
+	tests := []struct {
+		name   string
+		pushed int    // chunks accepted before the stream is behind
+		tail   string // unread when the connection closed
+	}{
+		{"queue only", compressedChunkQueue, ""},
+		{"with tail", compressedChunkQueue, "tail"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			woken := int32(0)
+			s := newChunkStream(func() { atomic.AddInt32(&woken, 1) })
+			var expected bytes.Buffer
+			for i := 0; i < test.pushed; i++ {
+				chunk := []byte{byte('a' + i%26)}
+				if err := s.push(chunk); err != nil {
+					t.Fatalf("push %d: %v", i, err)
+				}
+				expected.Write(chunk)
+			}
+			if err := s.push([]byte("z")); err != errStreamBehind {
+				t.Fatalf("got %v for a full queue, expected %v", err, errStreamBehind)
+			}
+			// refused without trying until woken
+			if err := s.push([]byte("z")); err != errStreamBehind {
+				t.Fatalf("got %v while behind, expected %v", err, errStreamBehind)
+			}
+
+			buf := make([]byte, test.pushed)
+			if _, err := io.ReadFull(s, buf); err != nil {
+				t.Fatal(err)
+			}
+			if atomic.LoadInt32(&woken) != 1 {
+				t.Fatalf("woken %d times after the queue drained, expected once", woken)
+			}
+			if err := s.push([]byte("z")); err != nil {
+				t.Fatalf("got %v once woken", err)
+			}
+			expected.WriteString("z")
+			s.close([]byte(test.tail))
+			expected.WriteString(test.tail)
+
+			rest, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf) + string(rest); got != expected.String() {
+				t.Fatalf("got %q, expected %q", got, expected.String())
+			}
+		})
+	}
+}
@@ -13,14 +13,167 @@ type Config struct {
 	Stats    *StatsConfig
 	General  *GeneralConfig
 	Bus      *BusConfig
+	Scrape   *ScrapeConfig
 }
+
+// BusConfig tunes the queue between receivers and the store. The block
+// overflow policy waits in the event loop of the sending connection, every
+// other connection of that loop stalls with it and is not checked for
+// idleness meanwhile.
 type BusConfig struct {
-	Queued bool
+	Queued   bool
+	Capacity int    // queued datapoints, unbounded when 0
+	Overflow string // when full, drop-newest (default), drop-oldest or block the senders
+	Workers  int    // goroutines writing to the store and index, 1 by default
+	Shard    bool   // a queue per worker picked by metric hash, keeps per series ordering
+	Handoff  int    // unqueued mode, datapoints buffered for the workers, 1024 by default
+	Spill    *SpillConfig
+}
+
+// SpillConfig is the on-disk log datapoints go to while the store or the
+// index is failing
+type SpillConfig struct {
+	Dir         string
+	SegmentSize int64  // bytes per segment file, 64MB by default
+	MaxSize     int64  // bytes on disk, the oldest segments are dropped beyond it, unbounded when 0
+	MaxAge      string // segments not written for that long are dropped, kept until replayed when empty
+	Fsync       string // always, interval (default) or never
+	Interval    string // fsync period, 1s by default
 }
 type EndpointConfig struct {
-	Port      int
-	Multicore bool
-	Reuseport bool
+	// plaintext tcp listener
+	ListenerConfig `config:",squash"`
+	Multicore      bool
+	Reuseport      bool
+	// optional listeners, disabled when not set
+	Pickle *ListenerConfig
+	Udp    *ListenerConfig
+	Tls    *TLSListenerConfig
+	Http   *HTTPListenerConfig
+	Unix   *UnixListenerConfig
+	// receivers served on the http listener
+	Prometheus *PrometheusConfig
+	Otlp       *OTLPConfig
+	Datadog    *DatadogConfig
+	// receivers with an optional own tcp listener, also served on the http listener when enabled
+	Influx   *InfluxConfig
+	Opentsdb *OpenTSDBConfig
+	// aggregating listeners
+	Statsd *StatsdConfig
+	// binary protocol listeners
+	Collectd *CollectdConfig
+}
+type ListenerConfig struct {
+	Port          int
+	Buffer        int    // read buffer size in bytes, 64KB by default
+	MaxLineLength int    // longer lines are dropped, 16KB by default
+	Parser        string // strict (default) aborts the batch on a bad line, lenient skips only the line
+	Compression   string // stream listeners only, none (default), gzip, snappy (framed) or lz4 (frame)
+	Backlog       int    // compressed streams, bytes buffered while decompression is behind before the connection is closed, 64MB by default
+	Proxy         bool   // stream listeners only, every connection starts with a PROXY protocol v1 or v2 header
+	SourceStats   bool   // connections and lines per client address under <listener>.source.<address>
+	// gnet, tls and http listeners
+	Allow          []string // client networks or addresses, everyone when empty
+	Deny           []string // takes precedence over allow
+	TrustedProxies []string // gnet stream listeners, peers allowed to send PROXY headers, without them the peer has to pass allow/deny too
+	MaxConnections int      // stream listeners, unlimited by default
+	IdleTimeout    string   // stream listeners, connections quiet for longer are closed, e.g. 5m, between requests for http
+}
+type TLSListenerConfig struct {
+	ListenerConfig `config:",squash"`
+	Cert           string // PEM certificate (chain) path
+	Key            string // PEM private key path
+	Ca             string // optional, client certificates are required and verified against this bundle
+	Reload         string // how often files are checked for changes, 1m by default
+}
+type UnixListenerConfig struct {
+	ListenerConfig `config:",squash"`
+	Path           string // socket file, must be lowercase
+	Mode           string // octal file permissions, 0660 by default
+}
+type HTTPListenerConfig struct {
+	ListenerConfig `config:",squash"`
+	MaxBodySize    int    // bytes after decompression, 32MB by default
+	Timeout        string // request read timeout, 1m by default
+}
+type PrometheusConfig struct {
+	Path     string // remote_write path, /api/v1/write by default
+	Prefix   string
+	Mappings []PrometheusMappingConfig // first match wins, series without a match are dropped
+}
+type PrometheusMappingConfig struct {
+	Match    string // regexp on the metric name, empty matches everything
+	Tagged   bool   // labels become tags, otherwise the template renders a dotted path
+	Template string // e.g. {job}.{instance}.{__name__}
+}
+type OTLPConfig struct {
+	Path       string // OTLP/HTTP metrics path, /v1/metrics by default
+	Prefix     string
+	Template   string // path template over resource and datapoint attributes, {name} (metric name) by default
+	Tagged     bool   // attributes not used by the template become tags
+	Histograms bool   // flatten histograms into .count, .sum and .bucket.<le>, dropped otherwise
+}
+type DatadogConfig struct {
+	Path   string // series intake path, /api/v1/series by default
+	Prefix string
+	Tagged bool // datadog tags (and host) become graphite tags, otherwise tag values are appended to the path
+}
+type InfluxConfig struct {
+	// tcp listener, disabled when port is not set
+	ListenerConfig `config:",squash"`
+	Path           string // http write path, /write by default
+	Prefix         string
+	Precision      string   // timestamp precision of tcp lines (ns, us, ms, s, m, h), ns by default
+	Templates      []string // `[measurement glob ]template`, first match wins, host.tags.measurement.field by default
+	Tagged         bool     // measurement.field with influx tags as graphite tags, templates are not used
+}
+type OpenTSDBConfig struct {
+	// telnet tcp listener, disabled when port is not set
+	ListenerConfig `config:",squash"`
+	Path           string // http put path, /api/put by default
+	Prefix         string
+	Tagged         bool     // opentsdb tags become graphite tags, otherwise tag values are appended to the path
+	Tags           []string // tag keys appended in this order, all tags sorted by key by default
+}
+type StatsdConfig struct {
+	ListenerConfig `config:",squash"`
+	Network        string    // udp, tcp or both (default) on the same port
+	Flush          string    // aggregation interval, 10s by default
+	Percentiles    []float64 // timer percentiles, 90 by default
+	Tagged         bool      // dogstatsd |#tags become graphite tags, otherwise tag values are appended to the name
+	Prefix         StatsdPrefixConfig
+}
+type StatsdPrefixConfig struct {
+	Counter string // stats.counters by default
+	Timer   string // stats.timers by default
+	Gauge   string // stats.gauges by default
+	Set     string // stats.sets by default
+}
+type CollectdConfig struct {
+	// udp listener, 25826 by default
+	ListenerConfig `config:",squash"`
+	Prefix         string   // collectd by default
+	Security       string   // minimal accepted level: none (default), sign or encrypt
+	AuthFile       string   // `user: password` lines, required for sign and encrypt
+	TypesDB        []string // types.db files naming values of multi value types, indexes are used otherwise
+}
+type ScrapeConfig struct {
+	Interval string // default scrape interval, 1m by default
+	Timeout  string // default scrape timeout, 10s by default
+	Refresh  string // how often discovery files are re-read, 1m by default
+	Jobs     []ScrapeJobConfig
+}
+type ScrapeJobConfig struct {
+	Name     string // job label
+	Scheme   string // http (default) or https
+	Path     string // /metrics by default
+	Interval string
+	Timeout  string
+	Targets  []string          // static host:port targets
+	Files    []string          // file discovery globs, prometheus file_sd JSON or YAML
+	Labels   map[string]string // added to every target
+	Prefix   string
+	Mappings []PrometheusMappingConfig // naming as for remote_write, first match wins
 }
 type StoreConfig struct {
 	Driver     string
@@ -32,6 +185,14 @@ type StoreConfig struct {
 	Username   string
 	Password   string
 	Table      string
+	Batch      struct {
+		Count       int    // datapoints per bundle, writes are not bundled when 0
+		Bytes       int    // bundle size that triggers a write, 1MB by default
+		Delay       string // a bundle is written at the latest after that, 1s by default
+		Handlers    int    // bundles written at once, 1 by default
+		Concurrency int    // batches in flight per bundle, 16 by default
+		Buffer      int    // bytes in bundles before workers wait, 1GB by default
+	}
 }
 type IndexConfig struct {
 	Driver    string
@@ -49,6 +210,7 @@ type IndexConfig struct {
 	Cache struct {
 		Size int // in bytes max cache size
 	}
+	Origin bool // store the sender address of the first datapoint in new docs
 }
 type StatsConfig struct {
 	Path     string
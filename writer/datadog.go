@@ -0,0 +1,108 @@
+// datadog
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type datadogSeries struct {
+	Metric string          `json:"metric"`
+	Points [][]json.Number `json:"points"` // [[timestamp, value], ...]
+	Type   string          `json:"type"`   // gauge, rate or count, values are kept as sent
+	Host   string          `json:"host"`
+	Tags   []string        `json:"tags"`
+}
+
+type datadogPayload struct {
+	Series []datadogSeries `json:"series"`
+}
+
+// DatadogReceiver implements the `/api/v1/series` intake on the shared HTTP
+// server, the host becomes the `host` tag.
+type DatadogReceiver struct {
+	prefix string
+	tagged bool
+	server *HTTPServer
+	stats  *Stats
+	bus    *Bus
+}
+
+func (d *DatadogReceiver) name(series *datadogSeries) (string, map[string]string, error) {
+	metric := statsdName(series.Metric)
+	if metric == "" {
+		return "", nil, errBadMessage
+	}
+	tags := ParseDatadogTags(series.Tags)
+	if series.Host != "" {
+		tags["host"] = series.Host
+	}
+	if d.tagged {
+		return d.prefix + metric, TagsFromLabels(tags), nil
+	}
+	return AppendTagValues(d.prefix+metric, tags, nil), nil, nil
+}
+
+func (d *DatadogReceiver) series(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		d.server.fail(w, http.StatusMethodNotAllowed, errors.New("method_not_allowed"))
+		return
+	}
+	d.stats.Record("datadog", "requests")
+	body, err := d.server.readBody(w, r)
+	if err != nil {
+		d.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	var payload datadogPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		d.stats.Record("parser.errors", "bad_json")
+		d.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var accepted, rejected int64
+	for i := range payload.Series {
+		series := &payload.Series[i]
+		name, tags, err := d.name(series)
+		if err != nil {
+			rejected += int64(len(series.Points))
+			continue
+		}
+		for _, point := range series.Points {
+			if len(point) != 2 {
+				rejected++
+				continue
+			}
+			ts, terr := point[0].Float64()
+			value, verr := point[1].Float64()
+			if terr != nil || verr != nil || math.IsNaN(value) {
+				rejected++
+				continue
+			}
+			dp := NewTaggedDataPoint(name, tags, value, int64(ts))
+			d.bus.Emit(&dp)
+			accepted++
+		}
+	}
+	d.stats.Record("datadog", "accepted", accepted)
+	d.stats.Record("datadog", "rejected", rejected)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "ok"})
+}
+
+func NewDatadogReceiver(config *DatadogConfig, server *HTTPServer, stats *Stats, bus *Bus) *DatadogReceiver {
+	if config.Path == "" {
+		config.Path = "/api/v1/series"
+	}
+	d := &DatadogReceiver{tagged: config.Tagged, server: server, stats: stats, bus: bus}
+	if config.Prefix != "" {
+		d.prefix = config.Prefix + "."
+	}
+	server.Handle(config.Path, d.series)
+	log.Info("Datadog series intake enabled on ", config.Path)
+	return d
+}
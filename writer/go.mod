@@ -6,14 +6,19 @@ require (
 	github.com/Pallinder/go-randomdata v1.2.0
 	github.com/aws/aws-sdk-go-v2/config v1.18.19
 	github.com/gocql/gocql v1.3.2
+	github.com/golang/snappy v0.0.3
 	github.com/hashicorp/golang-lru/v2 v2.0.2
 	github.com/oleiade/lane/v2 v2.0.0
 	github.com/opensearch-project/opensearch-go/v2 v2.2.0
 	github.com/panjf2000/gnet/v2 v2.2.6
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/pkg/profile v1.7.0
 	github.com/sherifabdlnaby/configuro v0.0.3
 	github.com/sirupsen/logrus v1.2.0
+	go.opentelemetry.io/proto/otlp v1.0.0
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 require (
@@ -33,8 +38,9 @@ require (
 	github.com/go-playground/locales v0.13.0 // indirect
 	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/go-playground/validator v9.31.0+incompatible // indirect
-	github.com/golang/snappy v0.0.3 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/pprof v0.0.0-20211214055906-6f57359322fd // indirect
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.16.0 // indirect
 	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/joho/godotenv v1.3.0 // indirect
@@ -54,12 +60,15 @@ require (
 	go.uber.org/zap v1.21.0 // indirect
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/exp v0.0.0-20220827204233-334a2380cb91 // indirect
-	golang.org/x/sys v0.3.0 // indirect
-	golang.org/x/term v0.1.0 // indirect
-	golang.org/x/text v0.4.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/term v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20230530153820-e85fd2cbaebc // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230530153820-e85fd2cbaebc // indirect
+	google.golang.org/grpc v1.56.2 // indirect
 	gopkg.in/go-playground/validator.v9 v9.31.0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/ini.v1 v1.51.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
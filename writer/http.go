@@ -0,0 +1,252 @@
+// http
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultMaxBodySize = 32 << 20
+
+var (
+	errBodyTooLarge        = errors.New("body_too_large")
+	errUnsupportedEncoding = errors.New("unsupported_content_encoding")
+)
+
+// HTTPServer hosts all HTTP based receivers on a single port, each protocol
+// registers its own path.
+type HTTPServer struct {
+	lineHandler
+
+	config *HTTPListenerConfig
+	acl    *accessList
+	mux    *http.ServeMux
+	http   *http.Server
+}
+
+type IngestResult struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+type jsonDataPoint struct {
+	Metric    string   `json:"metric"`
+	Value     *float64 `json:"value"`
+	Timestamp float64  `json:"timestamp"`
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("Failed writing response: ", err)
+	}
+}
+
+// readBody returns the (decompressed) request body, limited to MaxBodySize
+// both before and after decompression.
+func (server *HTTPServer) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	limit := int64(server.config.MaxBodySize)
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, limit)
+
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		// zlib wrapped, as sent by the datadog agent
+		zr, err := zlib.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	case "snappy":
+		// block format, as used by prometheus remote_write
+		compressed, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		size, err := snappy.DecodedLen(compressed)
+		if err != nil {
+			return nil, err
+		}
+		if int64(size) > limit {
+			return nil, errBodyTooLarge
+		}
+		return snappy.Decode(nil, compressed)
+	default:
+		return nil, errUnsupportedEncoding
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, errBodyTooLarge
+		}
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// fail answers with a client error and records it under the server stats
+func (server *HTTPServer) fail(w http.ResponseWriter, status int, err error) {
+	server.stats.Record(server.name, "errors")
+	http.Error(w, err.Error(), status)
+}
+
+// reply records the ingestion outcome and answers with the counts, a request
+// with nothing accepted but something rejected is a client error.
+func (server *HTTPServer) reply(w http.ResponseWriter, result IngestResult) {
+	server.stats.Record(server.name, "accepted", int64(result.Accepted))
+	server.stats.Record(server.name, "rejected", int64(result.Rejected))
+	status := http.StatusOK
+	if result.Accepted == 0 && result.Rejected > 0 {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, result)
+}
+
+// graphite accepts either the plaintext protocol or a JSON array of
+// {metric, value, timestamp}, selected by Content-Type.
+func (server *HTTPServer) graphite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		server.fail(w, http.StatusMethodNotAllowed, errors.New("method_not_allowed"))
+		return
+	}
+	server.stats.Record(server.name, "requests")
+	body, err := server.readBody(w, r)
+	if err != nil {
+		server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var result IngestResult
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		result, err = server.graphiteJSON(body, remoteAddr(r))
+		if err != nil {
+			server.fail(w, http.StatusBadRequest, err)
+			return
+		}
+	default:
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+		result.Accepted, result.Rejected = server.parsePlain(body, remoteAddr(r))
+	}
+	server.reply(w, result)
+}
+
+func (server *HTTPServer) graphiteJSON(body []byte, client net.Addr) (IngestResult, error) {
+	var result IngestResult
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return result, err
+	}
+	origin := clientHost(client)
+	for _, item := range items {
+		var jdp jsonDataPoint
+		err := json.Unmarshal(item, &jdp)
+		if err == nil && (jdp.Metric == "" || jdp.Value == nil) {
+			err = errBadMessage
+		}
+		var dp DataPoint
+		if err == nil {
+			dp, err = NewDataPoint(jdp.Metric, *jdp.Value, int64(jdp.Timestamp))
+		}
+		if err != nil {
+			result.Rejected++
+			server.stats.Record("parser.errors", "bad_json")
+			server.sampleParseError(item, err, client)
+			continue
+		}
+		dp.Origin = origin
+		server.bus.Emit(&dp)
+		result.Accepted++
+	}
+	return result, nil
+}
+
+// Handle registers an additional receiver on the shared HTTP port
+func (server *HTTPServer) Handle(path string, handler http.HandlerFunc) {
+	server.mux.HandleFunc(path, handler)
+}
+
+func (server *HTTPServer) Start() {
+	listener, err := net.Listen("tcp", server.http.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Info("Server started: listening on http://", server.http.Addr)
+	err = server.http.Serve(newGuardedListener(listener, server.name, server.acl, server.config.MaxConnections, server.stats))
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func (server *HTTPServer) Shutdown(ctx context.Context) {
+	log.Info("Shutting down server http://", server.http.Addr, "...")
+	server.http.Shutdown(ctx)
+}
+
+func NewHTTPServer(config *HTTPListenerConfig, stats *Stats, bus *Bus) *HTTPServer {
+	if config.MaxBodySize < 1 {
+		config.MaxBodySize = DefaultMaxBodySize
+	}
+	server := &HTTPServer{
+		lineHandler: newLineHandler("http", &config.ListenerConfig, stats, bus),
+		config:      config,
+		mux:         http.NewServeMux(),
+	}
+	acl, err := newAccessList(config.Allow, config.Deny)
+	if err != nil {
+		log.Fatal(err, " in the http listener access list")
+	}
+	server.acl = acl
+	if config.Proxy || len(config.TrustedProxies) > 0 {
+		log.Warn("PROXY protocol is not supported by the http listener, ignored")
+	}
+	server.http = &http.Server{
+		Addr:              fmt.Sprintf(":%d", config.Port),
+		Handler:           server.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       ParseDurationWithFallback(config.Timeout, time.Minute),
+	}
+	if config.IdleTimeout != "" {
+		server.http.IdleTimeout = ParseDurationWithFallback(config.IdleTimeout, 0)
+	}
+	server.Handle("/graphite", server.graphite)
+	return server
+}
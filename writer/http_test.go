@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPGraphiteContentType(t *testing.T) {
+	plain := "a.b 1 1700000000\nc.d 2 1700000000\n"
+	payload := `[{"metric": "a.b", "value": 1, "timestamp": 1700000000}, {"metric": "c.d", "value": 2, "timestamp": 1700000000}]`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		accepted    int
+	}{
+		{"json", "application/json", payload, http.StatusOK, 2},
+		{"json with charset", "application/json; charset=utf-8", payload, http.StatusOK, 2},
+		{"json mixed case", "Application/JSON", payload, http.StatusOK, 2},
+		{"plain", "text/plain", plain, http.StatusOK, 2},
+		{"no content type", "", plain, http.StatusOK, 2},
+		{"json as plain", "text/plain", payload, http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus, drain := newRecordBus()
+			defer drain()
+			server := NewHTTPServer(&HTTPListenerConfig{}, NewStats(&StatsConfig{}, "test"), bus)
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			w := httptest.NewRecorder()
+			server.graphite(w, r)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d: %s", w.Code, test.status, w.Body)
+			}
+			var result IngestResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Accepted != test.accepted {
+				t.Fatalf("got %d accepted, expected %d", result.Accepted, test.accepted)
+			}
+		})
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"encoding/hex"
-	"fmt"
+	"encoding/json"
 	"net"
 	"net/http"
 	"reflect"
@@ -39,9 +40,23 @@ type OpensearchIndex struct {
 }
 
 type PathDoc struct {
-	path  string
-	leaf  bool
-	depth int
+	Depth  int    `json:"depth"`
+	Tenant string `json:"tenant"`
+	Leaf   bool   `json:"leaf"`
+	Path   string `json:"path"`
+	Origin string `json:"origin,omitempty"`
+}
+
+// TagDoc describes a single tagged series, tags are stored both as names and
+// as name=value pairs so series can be looked up by either.
+type TagDoc struct {
+	Tenant   string   `json:"tenant"`
+	Path     string   `json:"path"`
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags"`
+	TagNames []string `json:"tag_names"`
+	Leaf     bool     `json:"leaf"`
+	Origin   string   `json:"origin,omitempty"`
 }
 
 func MD5Sum(input string) string {
@@ -51,17 +66,18 @@ func MD5Sum(input string) string {
 	return hex.EncodeToString(hashSum)
 }
 
-func (idx *OpensearchIndex) exists(metric string) bool {
+// exists fails when opensearch cannot be reached
+func (idx *OpensearchIndex) exists(metric string) (bool, error) {
 	getter := opensearchapi.GetRequest{Index: idx.config.Name, DocumentID: MD5Sum(metric)}
 	res, err := getter.Do(context.Background(), idx.client)
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
-	ret := (err == nil && res.StatusCode == 200)
 	if err != nil {
 		idx.stats.Record("index", "check_exits.error")
+		return false, err
 	}
-	return ret
+	if res.Body != nil {
+		defer res.Body.Close()
+	}
+	return res.StatusCode == 200, nil
 }
 
 func (idx *OpensearchIndex) isCached(metric string) bool {
@@ -76,6 +92,11 @@ func (idx *OpensearchIndex) Index(datapoint *DataPoint) error {
 		return nil
 	}
 
+	if datapoint.Tags != nil {
+		// tagged series live outside of the dotted tree
+		return idx.indexTagged(datapoint)
+	}
+
 	segments := strings.Split(datapoint.Metric, ".")
 
 	for i, j := 1, len(segments); i <= j; i++ {
@@ -86,8 +107,15 @@ func (idx *OpensearchIndex) Index(datapoint *DataPoint) error {
 			idx.stats.Record("index", "cache.hit")
 		} else {
 			idx.stats.Record("index", "cache.miss")
-			if !idx.exists(metric) {
-				idx.add(PathDoc{depth: i, leaf: isLeaf, path: metric})
+			exists, err := idx.exists(metric)
+			if err != nil {
+				// not cached, the path is checked again with the next datapoint
+				return err
+			}
+			if !exists {
+				if err := idx.add(PathDoc{Depth: i, Leaf: isLeaf, Path: metric, Origin: idx.origin(datapoint)}); err != nil {
+					return err
+				}
 			} else {
 				idx.stats.Record("index", "doc.already_in")
 			}
@@ -97,6 +125,36 @@ func (idx *OpensearchIndex) Index(datapoint *DataPoint) error {
 	return nil
 }
 
+func (idx *OpensearchIndex) indexTagged(datapoint *DataPoint) error {
+	idx.stats.Record("index", "cache.miss")
+	exists, err := idx.exists(datapoint.Metric)
+	if err != nil {
+		return err
+	}
+	if exists {
+		idx.stats.Record("index", "doc.already_in")
+	} else {
+		doc := TagDoc{Tenant: "NONE", Path: datapoint.Metric, Name: datapoint.Name(), Leaf: true, Origin: idx.origin(datapoint)}
+		for _, k := range SortedTagKeys(datapoint.Tags) {
+			doc.TagNames = append(doc.TagNames, k)
+			doc.Tags = append(doc.Tags, k+"="+datapoint.Tags[k])
+		}
+		if err := idx.addTagged(doc); err != nil {
+			return err
+		}
+	}
+	idx.cache.Add(datapoint.Metric, 1)
+	return nil
+}
+
+// origin is the sender recorded with new docs, when enabled
+func (idx *OpensearchIndex) origin(datapoint *DataPoint) string {
+	if !idx.config.Origin {
+		return ""
+	}
+	return datapoint.Origin
+}
+
 func (idx *OpensearchIndex) flushEnd(ctx context.Context) {
 	ws := idx.bulkIndexer.Stats()
 	v := reflect.ValueOf(ws)
@@ -115,21 +173,46 @@ func (idx *OpensearchIndex) Shutdown(ctx context.Context) {
 	idx.bulkIndexer.Close(ctx)
 }
 
-func (idx *OpensearchIndex) add(doc PathDoc) {
+func (idx *OpensearchIndex) add(doc PathDoc) error {
 	// set dummy tenant for disthene-compat
-	jdoc := fmt.Sprintf(`{"depth": %d, "tenant": "NONE", "leaf": %t, "path": "%s"}`, doc.depth, doc.leaf, doc.path)
+	doc.Tenant = "NONE"
+	jdoc, err := json.Marshal(doc)
+	if err != nil {
+		log.Error("Unexpected error: ", err)
+		return nil
+	}
+	err = idx.bulkIndexer.Add(
+		context.Background(),
+		opensearchutil.BulkIndexerItem{
+			Action:     "index",
+			DocumentID: MD5Sum(doc.Path),
+			Body:       bytes.NewReader(jdoc),
+		},
+	)
+	if err != nil {
+		log.Error("Unexpected error: ", err)
+	}
+	return err
+}
 
-	err := idx.bulkIndexer.Add(
+func (idx *OpensearchIndex) addTagged(doc TagDoc) error {
+	jdoc, err := json.Marshal(doc)
+	if err != nil {
+		log.Error("Unexpected error: ", err)
+		return nil
+	}
+	err = idx.bulkIndexer.Add(
 		context.Background(),
 		opensearchutil.BulkIndexerItem{
 			Action:     "index",
-			DocumentID: MD5Sum(doc.path),
-			Body:       strings.NewReader(jdoc),
+			DocumentID: MD5Sum(doc.Path),
+			Body:       bytes.NewReader(jdoc),
 		},
 	)
 	if err != nil {
-		log.Error("Unexpected error: %s", err)
+		log.Error("Unexpected error: ", err)
 	}
+	return err
 }
 
 func NewOpenSearch(config *IndexConfig, onFlushEnd func(context.Context)) (*opensearch.Client, opensearchutil.BulkIndexer, error) {
@@ -198,7 +281,7 @@ func NewOpensearchIndex(config *IndexConfig, stats *Stats) (IIndex, error) {
 		config:      config,
 		client:      nil,
 		bulkIndexer: nil,
-		lastStats:   opensearchutil.BulkIndexerStats{0, 0, 0, 0, 0, 0, 0, 0},
+		lastStats:   opensearchutil.BulkIndexerStats{},
 		stats:       stats,
 	}
 
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/opensearch-project/opensearch-go/v2/opensearchutil"
+)
+
+// bulkRecorder keeps the bodies of added items
+type bulkRecorder struct {
+	opensearchutil.BulkIndexer
+	bodies [][]byte
+}
+
+func (b *bulkRecorder) Add(ctx context.Context, item opensearchutil.BulkIndexerItem) error {
+	body, err := io.ReadAll(item.Body)
+	b.bodies = append(b.bodies, body)
+	return err
+}
+
+func TestOpensearchIndexAddEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  PathDoc
+	}{
+		{"plain", PathDoc{Depth: 2, Leaf: true, Path: "a.b"}},
+		{"quote", PathDoc{Depth: 1, Leaf: true, Path: `a"b`}},
+		{"backslash", PathDoc{Depth: 1, Path: `a\b`}},
+		{"control", PathDoc{Depth: 1, Path: "a\tb\x01"}},
+		{"origin", PathDoc{Depth: 1, Path: "a", Origin: `10.0.0.1"}, "x": "`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bulk := &bulkRecorder{}
+			idx := &OpensearchIndex{bulkIndexer: bulk}
+			if err := idx.add(test.doc); err != nil {
+				t.Fatal(err)
+			}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(bulk.bodies[0], &doc); err != nil {
+				t.Fatalf("invalid document %s: %v", bulk.bodies[0], err)
+			}
+			if doc["path"] != test.doc.Path || doc["tenant"] != "NONE" || doc["depth"] != float64(test.doc.Depth) || doc["leaf"] != test.doc.Leaf {
+				t.Fatalf("got %v", doc)
+			}
+			if origin, ok := doc["origin"]; ok != (test.doc.Origin != "") || (ok && origin != test.doc.Origin) {
+				t.Fatalf("got origin %v", doc["origin"])
+			}
+		})
+	}
+}
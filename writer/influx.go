@@ -0,0 +1,401 @@
+// influx
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultInfluxTemplate = "host.tags.measurement.field"
+
+var (
+	errBadPrecision = errors.New("bad_precision")
+	errStringField  = errors.New("string_field")
+)
+
+var influxUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+
+type influxField struct {
+	key   string
+	value float64
+}
+
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      []influxField
+	timestamp   int64 // in the line precision, 0 when absent
+}
+
+// influxSplit splits on sep not preceded by a backslash and, when quoted is
+// set, not within a double quoted string value.
+func influxSplit(s string, sep byte, quoted bool) []string {
+	var parts []string
+	start, inQuotes := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			if quoted {
+				inQuotes = !inQuotes
+			}
+		case sep:
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// influxIndex returns the first sep not preceded by a backslash
+func influxIndex(s string, sep byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return i
+		}
+	}
+	return -1
+}
+
+func parseInfluxFieldValue(v string) (float64, error) {
+	if v == "" {
+		return 0, errBadValue
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch last := v[len(v)-1]; {
+	case v[0] == '"':
+		return 0, errStringField
+	case last == 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, errBadValue
+		}
+		return float64(i), nil
+	case last == 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, errBadValue
+		}
+		return float64(u), nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errBadValue
+	}
+	return f, nil
+}
+
+// ParseInfluxLine parses `measurement[,tag=value...] field=value[,...] [timestamp]`,
+// string fields are skipped, a line with only string fields is rejected.
+func ParseInfluxLine(line string) (influxPoint, error) {
+	var point influxPoint
+
+	keyEnd := influxIndex(line, ' ')
+	if keyEnd < 1 {
+		return point, errBadMessage
+	}
+	key := influxSplit(line[:keyEnd], ',', false)
+	point.measurement = influxUnescaper.Replace(key[0])
+	if point.measurement == "" {
+		return point, errBadMessage
+	}
+	if len(key) > 1 {
+		point.tags = make(map[string]string, len(key)-1)
+		for _, tag := range key[1:] {
+			eq := influxIndex(tag, '=')
+			if eq < 1 || eq == len(tag)-1 {
+				return point, errBadTags
+			}
+			point.tags[influxUnescaper.Replace(tag[:eq])] = influxUnescaper.Replace(tag[eq+1:])
+		}
+	}
+
+	var sections []string
+	for _, section := range influxSplit(line[keyEnd+1:], ' ', true) {
+		if section != "" {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) < 1 || len(sections) > 2 {
+		return point, errBadMessage
+	}
+
+	var err error
+	for _, field := range influxSplit(sections[0], ',', true) {
+		eq := influxIndex(field, '=')
+		if eq < 1 {
+			return point, errBadMessage
+		}
+		value, ferr := parseInfluxFieldValue(field[eq+1:])
+		if ferr == errStringField {
+			err = ferr
+			continue
+		} else if ferr != nil {
+			return point, ferr
+		}
+		point.fields = append(point.fields, influxField{key: influxUnescaper.Replace(field[:eq]), value: value})
+	}
+	if len(point.fields) == 0 {
+		return point, err
+	}
+
+	if len(sections) == 2 {
+		point.timestamp, err = strconv.ParseInt(sections[1], 10, 64)
+		if err != nil {
+			return point, errBadTimestamp
+		}
+	}
+	return point, nil
+}
+
+// influxSeconds converts a timestamp of the given precision to unix seconds
+func influxSeconds(ts int64, precision string) (int64, error) {
+	switch precision {
+	case "", "ns", "n":
+		return ts / 1e9, nil
+	case "us", "u":
+		return ts / 1e6, nil
+	case "ms":
+		return ts / 1e3, nil
+	case "s":
+		return ts, nil
+	case "m":
+		return ts * 60, nil
+	case "h":
+		return ts * 3600, nil
+	}
+	return 0, errBadPrecision
+}
+
+// influxTemplate renders graphite paths following the graphite serializer
+// templates, e.g. `host.tags.measurement.field`. `measurement` and `field`
+// are replaced by their names, `tags` by the values of all tags not used
+// elsewhere in the template sorted by tag key, any other segment by the
+// value of the tag with that key. A field named `value` is omitted.
+type influxTemplate struct {
+	filter   string // glob on the measurement, empty matches everything
+	segments []string
+}
+
+func (t *influxTemplate) Render(point *influxPoint, field string) string {
+	used := make(map[string]bool)
+	for _, segment := range t.segments {
+		used[segment] = true
+	}
+	parts := make([]string, 0, len(t.segments)+len(point.tags))
+	for _, segment := range t.segments {
+		switch segment {
+		case "measurement":
+			parts = append(parts, SanitizeSegment(point.measurement))
+		case "field":
+			if field != "value" {
+				parts = append(parts, SanitizeSegment(field))
+			}
+		case "tags":
+			for _, k := range SortedTagKeys(point.tags) {
+				if !used[k] && point.tags[k] != "" {
+					parts = append(parts, SanitizeSegment(point.tags[k]))
+				}
+			}
+		default:
+			if v := point.tags[segment]; v != "" {
+				parts = append(parts, SanitizeSegment(v))
+			}
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func newInfluxTemplate(s string) (influxTemplate, error) {
+	var t influxTemplate
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		t.segments = strings.Split(fields[0], ".")
+	case 2:
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return t, err
+		}
+		t.filter = fields[0]
+		t.segments = strings.Split(fields[1], ".")
+	default:
+		return t, fmt.Errorf("invalid influx template %q", s)
+	}
+	return t, nil
+}
+
+// InfluxReceiver accepts InfluxDB line protocol on a TCP listener and/or the
+// `/write` path of the shared HTTP server.
+type InfluxReceiver struct {
+	lineHandler
+
+	prefix    string
+	precision string
+	tagged    bool
+	templates []influxTemplate
+	server    *HTTPServer
+}
+
+func (i *InfluxReceiver) template(measurement string) *influxTemplate {
+	for n := range i.templates {
+		t := &i.templates[n]
+		if t.filter == "" {
+			return t
+		}
+		if ok, _ := path.Match(t.filter, measurement); ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// emitPoint returns number of emitted datapoints
+func (i *InfluxReceiver) emitPoint(point *influxPoint, precision string) (int, error) {
+	ts, err := influxSeconds(point.timestamp, precision)
+	if err != nil {
+		return 0, err
+	}
+	emitted := 0
+	if i.tagged {
+		tags := TagsFromLabels(point.tags)
+		for _, field := range point.fields {
+			name := SanitizeSegment(point.measurement)
+			if field.key != "value" {
+				name += "." + SanitizeSegment(field.key)
+			}
+			dp := NewTaggedDataPoint(i.prefix+name, tags, field.value, ts)
+			i.bus.Emit(&dp)
+			emitted++
+		}
+		return emitted, nil
+	}
+
+	t := i.template(point.measurement)
+	if t == nil {
+		i.stats.Record(i.name, "unmatched")
+		return 0, nil
+	}
+	for _, field := range point.fields {
+		dp, err := NewDataPoint(i.prefix+t.Render(point, field.key), field.value, ts)
+		if err != nil {
+			return emitted, err
+		}
+		i.bus.Emit(&dp)
+		emitted++
+	}
+	return emitted, nil
+}
+
+func (i *InfluxReceiver) parse(buf []byte, client net.Addr, precision string) (int, int) {
+	accepted, rejected := 0, 0
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		point, err := ParseInfluxLine(line)
+		if err == nil {
+			var n int
+			n, err = i.emitPoint(&point, precision)
+			accepted += n
+		}
+		if err != nil {
+			rejected++
+			i.stats.Record("parser.errors", err.Error())
+			i.sampleParseError([]byte(line), err, client)
+		}
+	}
+	i.stats.Record(i.name, "accepted", int64(accepted))
+	i.stats.Record(i.name, "rejected", int64(rejected))
+	return accepted, rejected
+}
+
+// parseLines is the LineParser of the TCP listener
+func (i *InfluxReceiver) parseLines(buf []byte, client net.Addr) (int, int) {
+	return i.parse(buf, client, i.precision)
+}
+
+type influxError struct {
+	Error string `json:"error"`
+}
+
+func (i *InfluxReceiver) write(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		i.server.fail(w, http.StatusMethodNotAllowed, errors.New("method_not_allowed"))
+		return
+	}
+	i.stats.Record(i.name, "requests")
+	precision := r.URL.Query().Get("precision")
+	if _, err := influxSeconds(0, precision); err != nil {
+		i.server.stats.Record(i.server.name, "errors")
+		writeJSON(w, http.StatusBadRequest, influxError{Error: err.Error()})
+		return
+	}
+	body, err := i.server.readBody(w, r)
+	if err != nil {
+		i.server.stats.Record(i.server.name, "errors")
+		writeJSON(w, http.StatusBadRequest, influxError{Error: err.Error()})
+		return
+	}
+	if _, rejected := i.parse(body, remoteAddr(r), precision); rejected > 0 {
+		writeJSON(w, http.StatusBadRequest, influxError{Error: fmt.Sprintf("partial write: %d lines rejected", rejected)})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NewInfluxReceiver registers the write path when server is set
+func NewInfluxReceiver(config *InfluxConfig, server *HTTPServer, stats *Stats, bus *Bus) (*InfluxReceiver, error) {
+	if config.Path == "" {
+		config.Path = "/write"
+	}
+	if _, err := influxSeconds(0, config.Precision); err != nil {
+		return nil, fmt.Errorf("invalid influx precision %q", config.Precision)
+	}
+	if len(config.Templates) == 0 {
+		config.Templates = []string{DefaultInfluxTemplate}
+	}
+	if config.Parser != "" {
+		log.Warn("Influx lines are always parsed one by one, bad ones are skipped, parser ", config.Parser, " ignored")
+	}
+	i := &InfluxReceiver{
+		lineHandler: newLineHandler("influx", &config.ListenerConfig, stats, bus),
+		precision:   config.Precision,
+		tagged:      config.Tagged,
+		server:      server,
+	}
+	if config.Prefix != "" {
+		i.prefix = config.Prefix + "."
+	}
+	for _, s := range config.Templates {
+		t, err := newInfluxTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		i.templates = append(i.templates, t)
+	}
+	if server != nil {
+		server.Handle(config.Path, i.write)
+		log.Info("InfluxDB line protocol enabled on ", config.Path)
+	}
+	return i, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseInfluxLineEscaping(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected influxPoint
+	}{
+		{"plain", `cpu,host=a usage=1.5 1700000000`, influxPoint{
+			measurement: "cpu", tags: map[string]string{"host": "a"}, fields: []influxField{{"usage", 1.5}}, timestamp: 1700000000}},
+		{"measurement space and comma", `my\ cpu\,total usage=1`, influxPoint{
+			measurement: "my cpu,total", fields: []influxField{{"usage", 1}}}},
+		{"tag escapes", `cpu,ho\=st=a\ b\,c usage=1`, influxPoint{
+			measurement: "cpu", tags: map[string]string{"ho=st": "a b,c"}, fields: []influxField{{"usage", 1}}}},
+		{"field key escapes", `cpu us\ er\,x\=y=2i`, influxPoint{
+			measurement: "cpu", fields: []influxField{{"us er,x=y", 2}}}},
+		{"backslash", `c\\pu usage=1`, influxPoint{
+			measurement: `c\pu`, fields: []influxField{{"usage", 1}}}},
+		{"quoted string field", `cpu note="a b, c=d",usage=3u 5`, influxPoint{
+			measurement: "cpu", fields: []influxField{{"usage", 3}}, timestamp: 5}},
+		{"escaped quote", `cpu note="a \" b",usage=t`, influxPoint{
+			measurement: "cpu", fields: []influxField{{"usage", 1}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			point, err := ParseInfluxLine(test.line)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(point, test.expected) {
+				t.Fatalf("got %+v, expected %+v", point, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseInfluxLineErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		err  error
+	}{
+		{"no fields", `cpu`, errBadMessage},
+		{"escaped separator only", `cpu\ usage=1`, errBadMessage},
+		{"empty tag value", `cpu,host= usage=1`, errBadTags},
+		{"escaped tag equals", `cpu,host\=a usage=1`, errBadTags},
+		{"only strings", `cpu note="x"`, errStringField},
+		{"bad value", `cpu usage=abc`, errBadValue},
+		{"bad timestamp", `cpu usage=1 now`, errBadTimestamp},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseInfluxLine(test.line); !errors.Is(err, test.err) {
+				t.Fatalf("got %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
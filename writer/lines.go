@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lenient parser logs at most one malformed line sample per interval
+const parseErrorSampleInterval = 10 * time.Second
+
+// connState is attached to every stream connection, for gnet as its context
+type connState struct {
+	pending []byte // unfinished line carried over to the next read
+	discard bool   // skipping the remainder of an oversized line
+	// gnet listeners only
+	client     net.Addr     // real client, from the PROXY header when enabled
+	source     string       // stats unit of the client when source stats are enabled
+	awaitProxy bool         // PROXY header not received yet
+	stream     *chunkStream // compressed connections are read by a goroutine
+	active     int64        // unix nano of the last read, atomic
+}
+
+// feed hands complete lines from buf (prefixed with the pending data) to
+// onLines, the unfinished tail is copied aside for the next call. Lines
+// longer than maxLine are dropped up to the next newline, returns false then.
+func (state *connState) feed(buf []byte, maxLine int, onLines func(lines []byte)) bool {
+	if state.discard {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return true
+		}
+		buf = buf[i+1:]
+		state.discard = false
+	}
+	if len(state.pending) > 0 {
+		state.pending = append(state.pending, buf...)
+		buf = state.pending
+	}
+
+	end := bytes.LastIndexByte(buf, '\n') + 1
+	if end > 0 {
+		onLines(buf[:end])
+	}
+
+	rest := buf[end:]
+	if len(rest) > maxLine {
+		state.pending = nil
+		state.discard = true
+		return false
+	}
+	// buf is reused by the caller, keep a copy of the unfinished line
+	state.pending = append(state.pending[:0], rest...)
+	return true
+}
+
+// flush returns the unfinished line once the peer is gone, it is as complete
+// as it will ever be
+func (state *connState) flush() []byte {
+	if len(state.pending) == 0 || state.discard {
+		return nil
+	}
+	lines := append(state.pending, '\n')
+	state.pending = nil
+	return lines
+}
+
+// LineParser consumes complete newline terminated lines, returns the number
+// of accepted and rejected lines
+type LineParser func(buf []byte, client net.Addr) (int, int)
+
+// lineHandler turns complete plaintext lines into datapoints on the bus
+type lineHandler struct {
+	name       string // used as stats unit
+	lenient    bool
+	lastSample int64 // unix nano of the last logged parse error
+	stats      *Stats
+	bus        *Bus
+	// compressed streams, totals since start
+	compressedBytes   int64
+	decompressedBytes int64
+}
+
+// parsePlain emits datapoints from complete lines and returns the number of
+// accepted and rejected lines, in strict mode the remainder after a bad line is lost.
+func (h *lineHandler) parsePlain(buf []byte, client net.Addr) (int, int) {
+	var dps []DataPoint
+	failed := 0
+	if h.lenient {
+		dps = ParsePlainGraphiteProtocolLenient(buf, func(line []byte, err error) {
+			failed++
+			h.stats.Record("parser.errors", err.Error())
+			h.sampleParseError(line, err, client)
+		})
+	} else {
+		var err error
+		dps, err = ParsePlainGraphiteProtocol(buf)
+		if err != nil {
+			failed++
+			h.stats.Record("parser.errors", err.Error())
+		}
+	}
+
+	origin := clientHost(client)
+	for i := range dps {
+		dps[i].Origin = origin
+		h.bus.Emit(&dps[i])
+	}
+	return len(dps), failed
+}
+
+func (h *lineHandler) sampleParseError(line []byte, err error, client net.Addr) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&h.lastSample)
+	if now-last < int64(parseErrorSampleInterval) || !atomic.CompareAndSwapInt64(&h.lastSample, last, now) {
+		return
+	}
+	if len(line) > 256 {
+		line = line[:256]
+	}
+	log.WithFields(log.Fields{
+		"listener": h.name,
+		"client":   client,
+		"reason":   err.Error(),
+		"line":     string(bytes.TrimRight(line, "\r\n")),
+	}).Warn("Skipped malformed line")
+}
+
+func newLineHandler(name string, config *ListenerConfig, stats *Stats, bus *Bus) lineHandler {
+	if config.MaxLineLength < 1 {
+		config.MaxLineLength = DefaultMaxLineLength
+	}
+	if config.Parser != "" && config.Parser != "strict" && config.Parser != "lenient" {
+		log.Warn("Unknown parser mode ", config.Parser, " for ", name, " listener, using strict")
+	}
+	return lineHandler{
+		name:    name,
+		lenient: config.Parser == "lenient",
+		stats:   stats,
+		bus:     bus,
+	}
+}
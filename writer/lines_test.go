@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConnStateFeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		reads   []string
+		maxLine int
+		lines   []string // handed to onLines, in order
+		tooLong int      // reads returning false
+		flushed string   // returned by flush at close
+	}{
+		{"whole lines", []string{"a 1 1\nb 2 2\n"}, 16, []string{"a 1 1", "b 2 2"}, 0, ""},
+		{"split across reads", []string{"a 1", " 1\nb 2", " 2\n"}, 16, []string{"a 1 1", "b 2 2"}, 0, ""},
+		{"split at the newline", []string{"a 1 1", "\n", "b 2 2\n"}, 16, []string{"a 1 1", "b 2 2"}, 0, ""},
+		{"carried over several reads", []string{"a", ".b", ".c", " 1 1\n"}, 16, []string{"a.b.c 1 1"}, 0, ""},
+		{"too long and recovered", []string{"aaaaaaaa", "aaaaaaaaaa", "aa 1 1\nb 2 2\n"}, 8, []string{"b 2 2"}, 1, ""},
+		{"too long at once and recovered", []string{"ok 1 1\naaaaaaaaaaa", "aa 1 1\nb 2", " 2\n"}, 8, []string{"ok 1 1", "b 2 2"}, 1, ""},
+		{"flushed at close", []string{"a 1 1\nb 2", " 2"}, 16, []string{"a 1 1"}, 0, "b 2 2\n"},
+		{"not flushed while discarding", []string{"a 1 1\naaaaaaaaaaaa"}, 8, []string{"a 1 1"}, 1, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := &connState{}
+			var lines []string
+			onLines := func(buf []byte) {
+				if buf[len(buf)-1] != '\n' {
+					t.Fatalf("got unterminated lines %q", buf)
+				}
+				lines = append(lines, strings.Split(string(buf[:len(buf)-1]), "\n")...)
+			}
+			tooLong := 0
+			// the caller reuses its read buffer
+			scratch := make([]byte, 64)
+			for _, read := range test.reads {
+				n := copy(scratch, read)
+				if !state.feed(scratch[:n], test.maxLine, onLines) {
+					tooLong++
+				}
+				for i := range scratch {
+					scratch[i] = 'x'
+				}
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Fatalf("got lines %q, expected %q", lines, test.lines)
+			}
+			if tooLong != test.tooLong {
+				t.Fatalf("got %d reads too long, expected %d", tooLong, test.tooLong)
+			}
+			if flushed := string(state.flush()); flushed != test.flushed {
+				t.Fatalf("flushed %q, expected %q", flushed, test.flushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// opentsdb
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// opentsdbSeconds detects millisecond timestamps, opentsdb accepts both
+// (10 digits seconds, 13 digits milliseconds)
+func opentsdbSeconds(ts int64) int64 {
+	if ts > 9999999999 {
+		return ts / 1000
+	}
+	return ts
+}
+
+type opentsdbDataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.RawMessage   `json:"value"` // number or numeric string
+	Tags      map[string]string `json:"tags"`
+}
+
+type opentsdbError struct {
+	DataPoint json.RawMessage `json:"datapoint"`
+	Error     string          `json:"error"`
+}
+
+type opentsdbSummary struct {
+	Success int             `json:"success"`
+	Failed  int             `json:"failed"`
+	Errors  []opentsdbError `json:"errors,omitempty"`
+}
+
+// OpenTSDBReceiver accepts the telnet style `put` command on a TCP listener
+// and/or JSON on `/api/put` of the shared HTTP server.
+type OpenTSDBReceiver struct {
+	lineHandler
+
+	prefix string
+	tagged bool
+	tags   []string // tag keys appended to the path, all sorted by key when empty
+	server *HTTPServer
+}
+
+// DataPoint maps an opentsdb datapoint either to a tagged series or to the
+// metric path with tag values appended.
+func (o *OpenTSDBReceiver) DataPoint(metric string, ts int64, value float64, tags map[string]string) (DataPoint, error) {
+	// `;` would start graphite tags, tag values are sanitized
+	if metric == "" || strings.ContainsRune(metric, ';') || math.IsNaN(value) {
+		return DataPoint{}, errBadMessage
+	}
+	ts = opentsdbSeconds(ts)
+	if o.tagged {
+		if strings.ContainsAny(metric, "= ") {
+			return DataPoint{}, errBadMessage
+		}
+		return NewTaggedDataPoint(o.prefix+metric, TagsFromLabels(tags), value, ts), nil
+	}
+	return NewDataPoint(AppendTagValues(o.prefix+metric, tags, o.tags), value, ts)
+}
+
+// parsePut handles `put <metric> <timestamp> <value> [<tagk=tagv> ...]`
+func (o *OpenTSDBReceiver) parsePut(fields []string) (DataPoint, error) {
+	if len(fields) < 4 {
+		return DataPoint{}, errBadMessage
+	}
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || ts < 0 {
+		return DataPoint{}, errBadTimestamp
+	}
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return DataPoint{}, errBadValue
+	}
+	tags := make(map[string]string, len(fields)-4)
+	for _, tag := range fields[4:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return DataPoint{}, errBadTags
+		}
+		tags[k] = v
+	}
+	return o.DataPoint(fields[1], ts, value, tags)
+}
+
+// parseLines is the LineParser of the telnet listener, commands other than
+// put (e.g. version used by tcollector as a keepalive) are ignored.
+func (o *OpenTSDBReceiver) parseLines(buf []byte, client net.Addr) (int, int) {
+	accepted, rejected := 0, 0
+	for _, line := range bytes.Split(buf, []byte{'\n'}) {
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "put" {
+			o.stats.Record(o.name, "ignored")
+			continue
+		}
+		dp, err := o.parsePut(fields)
+		if err != nil {
+			rejected++
+			o.stats.Record("parser.errors", err.Error())
+			o.sampleParseError(line, err, client)
+			continue
+		}
+		o.bus.Emit(&dp)
+		accepted++
+	}
+	o.stats.Record(o.name, "accepted", int64(accepted))
+	o.stats.Record(o.name, "rejected", int64(rejected))
+	return accepted, rejected
+}
+
+func (o *OpenTSDBReceiver) putJSON(item json.RawMessage) error {
+	var odp opentsdbDataPoint
+	if err := json.Unmarshal(item, &odp); err != nil {
+		return err
+	}
+	raw := string(bytes.Trim(odp.Value, `"`))
+	if raw == "" {
+		return errBadValue
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return errBadValue
+	}
+	dp, err := o.DataPoint(odp.Metric, odp.Timestamp, value, odp.Tags)
+	if err != nil {
+		return err
+	}
+	o.bus.Emit(&dp)
+	return nil
+}
+
+// put accepts a single datapoint object or an array of them, answers like
+// opentsdb does, 204 or with `summary`/`details` a JSON summary.
+func (o *OpenTSDBReceiver) put(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		o.server.fail(w, http.StatusMethodNotAllowed, errors.New("method_not_allowed"))
+		return
+	}
+	o.stats.Record(o.name, "requests")
+	body, err := o.server.readBody(w, r)
+	if err != nil {
+		o.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var items []json.RawMessage
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &items)
+	} else {
+		items = []json.RawMessage{body}
+	}
+	if err != nil {
+		o.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, details := r.URL.Query()["details"]
+	_, summary := r.URL.Query()["summary"]
+	var result opentsdbSummary
+	for _, item := range items {
+		if err := o.putJSON(item); err != nil {
+			result.Failed++
+			o.stats.Record("parser.errors", "bad_json")
+			o.sampleParseError(item, err, remoteAddr(r))
+			if details {
+				result.Errors = append(result.Errors, opentsdbError{DataPoint: item, Error: err.Error()})
+			}
+			continue
+		}
+		result.Success++
+	}
+	o.stats.Record(o.name, "accepted", int64(result.Success))
+	o.stats.Record(o.name, "rejected", int64(result.Failed))
+
+	status := http.StatusNoContent
+	if result.Failed > 0 {
+		status = http.StatusBadRequest
+	} else if details || summary {
+		status = http.StatusOK
+	}
+	if details || summary || result.Failed > 0 {
+		writeJSON(w, status, result)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// NewOpenTSDBReceiver registers the put path when server is set
+func NewOpenTSDBReceiver(config *OpenTSDBConfig, server *HTTPServer, stats *Stats, bus *Bus) *OpenTSDBReceiver {
+	if config.Path == "" {
+		config.Path = "/api/put"
+	}
+	if config.Parser != "" {
+		log.Warn("OpenTSDB puts are always parsed one by one, bad ones are skipped, parser ", config.Parser, " ignored")
+	}
+	o := &OpenTSDBReceiver{
+		lineHandler: newLineHandler("opentsdb", &config.ListenerConfig, stats, bus),
+		tagged:      config.Tagged,
+		tags:        config.Tags,
+		server:      server,
+	}
+	if config.Prefix != "" {
+		o.prefix = config.Prefix + "."
+	}
+	if server != nil {
+		server.Handle(config.Path, o.put)
+		log.Info("OpenTSDB put enabled on ", config.Path)
+	}
+	return o
+}
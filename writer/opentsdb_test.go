@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestOpenTSDBDataPoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		tagged bool
+		metric string
+		tags   map[string]string
+		series string
+		err    error
+	}{
+		{"untagged", false, "sys.cpu", map[string]string{"host": "a", "dc": "eu"}, "tsdb.sys.cpu.eu.a", nil},
+		{"untagged value with separators", false, "sys.cpu", map[string]string{"host": "a;b=c.d"}, "tsdb.sys.cpu.a_b_c_d", nil},
+		{"untagged metric with semicolon", false, "sys.cpu;host=x", nil, "", errBadMessage},
+		{"tagged", true, "sys.cpu", map[string]string{"host": "a", "dc": "eu"}, "tsdb.sys.cpu;dc=eu;host=a", nil},
+		{"tagged value with semicolon", true, "sys.cpu", map[string]string{"host": "a;b"}, "tsdb.sys.cpu;host=a_b", nil},
+		{"tagged metric with semicolon", true, "sys.cpu;host=x", nil, "", errBadMessage},
+		{"tagged metric with space", true, "sys cpu", nil, "", errBadMessage},
+		{"empty metric", false, "", nil, "", errBadMessage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := &OpenTSDBReceiver{prefix: "tsdb.", tagged: test.tagged}
+			dp, err := o.DataPoint(test.metric, 1700000000000, 1, test.tags)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if dp.Metric != test.series || dp.Timestamp != 1700000000 {
+				t.Fatalf("got %s at %d, expected %s", dp.Metric, dp.Timestamp, test.series)
+			}
+			if test.tagged && !reflect.DeepEqual(dp.Tags, TagsFromLabels(test.tags)) {
+				t.Fatalf("got tags %v", dp.Tags)
+			}
+		})
+	}
+}
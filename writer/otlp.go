@@ -0,0 +1,246 @@
+// otlp
+package main
+
+import (
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	collmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLPReceiver implements OTLP/HTTP metrics export (protobuf and JSON) on the
+// shared HTTP server, gauges and sums are emitted as they are, histograms are
+// optionally flattened into .count, .sum and cumulative .bucket.<le> series.
+type OTLPReceiver struct {
+	server     *HTTPServer
+	prefix     string
+	template   *PathTemplate
+	used       []string // labels consumed by the template, not repeated as tags
+	tagged     bool
+	histograms bool
+	stats      *Stats
+	bus        *Bus
+}
+
+type otlpResult struct {
+	accepted int64
+	rejected int64
+	dropped  int64
+}
+
+func otlpValueString(v *commonpb.AnyValue) (string, bool) {
+	switch t := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return t.StringValue, true
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(t.BoolValue), true
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(t.IntValue, 10), true
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(t.DoubleValue, 'g', -1, 64), true
+	}
+	// arrays, kvlists and bytes have no sensible path representation
+	return "", false
+}
+
+func otlpLabels(base map[string]string, attributes []*commonpb.KeyValue) map[string]string {
+	labels := make(map[string]string, len(base)+len(attributes))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for _, kv := range attributes {
+		if value, ok := otlpValueString(kv.GetValue()); ok {
+			labels[kv.GetKey()] = value
+		}
+	}
+	return labels
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "inf"
+	}
+	return SanitizeSegment(strconv.FormatFloat(bound, 'g', -1, 64))
+}
+
+func (o *OTLPReceiver) emit(name string, labels map[string]string, value float64, timeUnixNano uint64, result *otlpResult) {
+	if math.IsNaN(value) {
+		result.rejected++
+		return
+	}
+	labels["name"] = name
+	path := o.template.Render(labels)
+	if path == "" {
+		result.dropped++
+		return
+	}
+	var tags map[string]string
+	if o.tagged {
+		tags = TagsFromLabels(labels, o.used...)
+	}
+	dp := NewTaggedDataPoint(o.prefix+path, tags, value, int64(timeUnixNano/1e9))
+	o.bus.Emit(&dp)
+	result.accepted++
+}
+
+func (o *OTLPReceiver) numberPoints(name string, resource map[string]string, points []*metricspb.NumberDataPoint, result *otlpResult) {
+	for _, point := range points {
+		if point.GetFlags()&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+			result.dropped++
+			continue
+		}
+		var value float64
+		switch v := point.GetValue().(type) {
+		case *metricspb.NumberDataPoint_AsDouble:
+			value = v.AsDouble
+		case *metricspb.NumberDataPoint_AsInt:
+			value = float64(v.AsInt)
+		default:
+			result.rejected++
+			continue
+		}
+		o.emit(name, otlpLabels(resource, point.GetAttributes()), value, point.GetTimeUnixNano(), result)
+	}
+}
+
+func (o *OTLPReceiver) histogramPoints(name string, resource map[string]string, points []*metricspb.HistogramDataPoint, result *otlpResult) {
+	for _, point := range points {
+		if point.GetFlags()&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+			result.dropped++
+			continue
+		}
+		labels := otlpLabels(resource, point.GetAttributes())
+		ts := point.GetTimeUnixNano()
+		o.emit(name+".count", labels, float64(point.GetCount()), ts, result)
+		if point.Sum != nil {
+			o.emit(name+".sum", labels, point.GetSum(), ts, result)
+		}
+		bounds := point.GetExplicitBounds()
+		var cumulative uint64
+		for i, count := range point.GetBucketCounts() {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(bounds) {
+				bound = bounds[i]
+			}
+			o.emit(name+".bucket."+formatBound(bound), labels, float64(cumulative), ts, result)
+		}
+	}
+}
+
+// Export walks the request and emits datapoints, returns how many points
+// were accepted, rejected (invalid) and dropped (unsupported).
+func (o *OTLPReceiver) Export(req *collmetrics.ExportMetricsServiceRequest) otlpResult {
+	var result otlpResult
+	for _, rm := range req.GetResourceMetrics() {
+		resource := otlpLabels(nil, rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, metric := range sm.GetMetrics() {
+				name := metric.GetName()
+				switch data := metric.GetData().(type) {
+				case *metricspb.Metric_Gauge:
+					o.numberPoints(name, resource, data.Gauge.GetDataPoints(), &result)
+				case *metricspb.Metric_Sum:
+					o.numberPoints(name, resource, data.Sum.GetDataPoints(), &result)
+				case *metricspb.Metric_Histogram:
+					if !o.histograms {
+						result.dropped += int64(len(data.Histogram.GetDataPoints()))
+						continue
+					}
+					o.histogramPoints(name, resource, data.Histogram.GetDataPoints(), &result)
+				case *metricspb.Metric_ExponentialHistogram:
+					result.dropped += int64(len(data.ExponentialHistogram.GetDataPoints()))
+				case *metricspb.Metric_Summary:
+					result.dropped += int64(len(data.Summary.GetDataPoints()))
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (o *OTLPReceiver) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		o.server.fail(w, http.StatusMethodNotAllowed, errors.New("method_not_allowed"))
+		return
+	}
+	o.stats.Record("otlp", "requests")
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var unmarshal func([]byte, proto.Message) error
+	var marshal func(proto.Message) ([]byte, error)
+	switch contentType {
+	case "application/x-protobuf":
+		unmarshal, marshal = proto.Unmarshal, proto.Marshal
+	case "application/json":
+		unmarshal, marshal = protojson.Unmarshal, protojson.Marshal
+	default:
+		o.server.fail(w, http.StatusUnsupportedMediaType, errors.New("unsupported_content_type"))
+		return
+	}
+
+	body, err := o.server.readBody(w, r)
+	if err != nil {
+		o.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	req := &collmetrics.ExportMetricsServiceRequest{}
+	if err := unmarshal(body, req); err != nil {
+		o.stats.Record("parser.errors", "bad_otlp")
+		o.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result := o.Export(req)
+	o.stats.Record("otlp", "accepted", result.accepted)
+	o.stats.Record("otlp", "rejected", result.rejected)
+	o.stats.Record("otlp", "dropped", result.dropped)
+
+	resp := &collmetrics.ExportMetricsServiceResponse{}
+	if result.rejected+result.dropped > 0 {
+		resp.PartialSuccess = &collmetrics.ExportMetricsPartialSuccess{
+			RejectedDataPoints: result.rejected + result.dropped,
+			ErrorMessage:       "invalid or unsupported datapoints",
+		}
+	}
+	out, err := marshal(resp)
+	if err != nil {
+		o.server.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out)
+}
+
+func NewOTLPReceiver(config *OTLPConfig, server *HTTPServer, stats *Stats, bus *Bus) *OTLPReceiver {
+	if config.Path == "" {
+		config.Path = "/v1/metrics"
+	}
+	if config.Template == "" {
+		config.Template = "{name}"
+	}
+	template := NewPathTemplate(config.Template, "name")
+	o := &OTLPReceiver{
+		server:     server,
+		template:   template,
+		used:       append(template.Labels(), "name"),
+		tagged:     config.Tagged,
+		histograms: config.Histograms,
+		stats:      stats,
+		bus:        bus,
+	}
+	if config.Prefix != "" {
+		o.prefix = config.Prefix + "."
+	}
+	server.Handle(config.Path, o.metrics)
+	log.Info("OTLP metrics receiver enabled on ", config.Path)
+	return o
+}
@@ -6,13 +6,26 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"strings"
 	"unsafe"
 )
 
+const DefaultMaxLineLength = 16 * 1024
+
 type DataPoint struct {
-	Metric    string
+	Metric    string // canonical series name, for tagged series `name;a=1;b=2`
 	Value     float64
 	Timestamp int64
+	Tags      map[string]string // nil for untagged series
+	Origin    string            // sender address when known, e.g. for the index
+}
+
+// Name returns the series name without tags
+func (dp *DataPoint) Name() string {
+	if i := strings.IndexByte(dp.Metric, ';'); i >= 0 {
+		return dp.Metric[:i]
+	}
+	return dp.Metric
 }
 
 // https://github.com/golang/go/issues/2632#issuecomment-66061057
@@ -20,17 +33,24 @@ func unsafeString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+var (
+	errBadMessage     = errors.New("bad_message")
+	errBadValue       = errors.New("bad_value")
+	errBadTimestamp   = errors.New("bad_timestamp")
+	errUnfinishedLine = errors.New("unfinished_line")
+)
+
 func PlainLine(p []byte) ([]byte, float64, int64, error) {
 	p = bytes.Trim(p, " \n\r")
 
 	i1 := bytes.IndexByte(p, ' ')
 	if i1 < 1 {
-		return nil, 0, 0, errors.New("bad_message")
+		return nil, 0, 0, errBadMessage
 	}
 
 	i2 := bytes.IndexByte(p[i1+1:], ' ')
 	if i2 < 1 {
-		return nil, 0, 0, errors.New("bad_message")
+		return nil, 0, 0, errBadMessage
 	}
 	i2 += i1 + 1
 
@@ -38,19 +58,31 @@ func PlainLine(p []byte) ([]byte, float64, int64, error) {
 
 	value, err := strconv.ParseFloat(unsafeString(p[i1+1:i2]), 64)
 	if err != nil || math.IsNaN(value) {
-		//return nil, 0, 0, fmt.Errorf("bad_message: %#v", string(p))
-		return nil, 0, 0, errors.New("bad_message")
+		return nil, 0, 0, errBadValue
 	}
 
 	tsf, err := strconv.ParseFloat(unsafeString(p[i2+1:i3]), 64)
 	if err != nil || math.IsNaN(tsf) {
-		return nil, 0, 0, errors.New("bad_message")
+		return nil, 0, 0, errBadTimestamp
 	}
 
 	return p[:i1], value, int64(tsf), nil
 }
 
+// ParsePlainGraphiteProtocol is the strict parser, it stops at the first
+// malformed line and returns datapoints parsed so far.
 func ParsePlainGraphiteProtocol(body []byte) ([]DataPoint, error) {
+	return parsePlainLines(body, nil)
+}
+
+// ParsePlainGraphiteProtocolLenient skips malformed lines, each of them is
+// reported to onError, so a single bad line does not discard the batch.
+func ParsePlainGraphiteProtocolLenient(body []byte, onError func(line []byte, err error)) []DataPoint {
+	result, _ := parsePlainLines(body, onError)
+	return result
+}
+
+func parsePlainLines(body []byte, onError func(line []byte, err error)) ([]DataPoint, error) {
 	var result []DataPoint
 
 	size := len(body)
@@ -60,21 +92,37 @@ MainLoop:
 	for offset < size {
 		lineEnd := bytes.IndexByte(body[offset:size], '\n')
 		if lineEnd < 0 {
-			return result, errors.New("unfinished_line")
+			if onError != nil {
+				onError(body[offset:size], errUnfinishedLine)
+				break MainLoop
+			}
+			return result, errUnfinishedLine
 		} else if lineEnd == 0 {
 			// skip empty line
 			offset++
 			continue MainLoop
 		}
 
-		name, value, timestamp, err := PlainLine(body[offset : offset+lineEnd+1])
+		line := body[offset : offset+lineEnd+1]
+		name, value, timestamp, err := PlainLine(line)
 		offset += lineEnd + 1
 
 		if err != nil {
+			if onError != nil {
+				onError(line, err)
+				continue MainLoop
+			}
 			return result, err
 		}
 
-		dp := DataPoint{Metric: string(name), Value: value, Timestamp: timestamp}
+		dp, err := NewDataPoint(string(name), value, timestamp)
+		if err != nil {
+			if onError != nil {
+				onError(line, err)
+				continue MainLoop
+			}
+			return result, err
+		}
 		result = append(result, dp)
 	}
 
@@ -0,0 +1,496 @@
+// pickle
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Pickle protocol frames are a 4 byte big-endian length followed by the
+// pickled list of (path, (timestamp, value)), same as carbon's MAX_LENGTH.
+const PickleMaxFrameSize = 1 << 20
+
+var (
+	errPickleUnsupported = errors.New("pickle_unsupported_opcode")
+	errPickleMalformed   = errors.New("bad_pickle")
+)
+
+type pickleMark struct{}
+type pickleTuple []interface{}
+
+// pickleList is kept by pointer, the stack and the memo share it so items
+// appended after a PUT are seen by a later GET
+type pickleList struct {
+	items []interface{}
+}
+
+// pickleMachine is a minimal unpickler that understands only data opcodes
+// (containers, strings, numbers), anything that could import or call Python
+// code (GLOBAL, REDUCE, BUILD, INST, OBJ, NEWOBJ, EXT...) is rejected.
+type pickleMachine struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+func (m *pickleMachine) read(n int) ([]byte, error) {
+	if n < 0 || m.pos+n > len(m.data) {
+		return nil, errPickleMalformed
+	}
+	b := m.data[m.pos : m.pos+n]
+	m.pos += n
+	return b, nil
+}
+
+func (m *pickleMachine) readLine() ([]byte, error) {
+	for i := m.pos; i < len(m.data); i++ {
+		if m.data[i] == '\n' {
+			b := m.data[m.pos:i]
+			m.pos = i + 1
+			return b, nil
+		}
+	}
+	return nil, errPickleMalformed
+}
+
+func (m *pickleMachine) push(v interface{}) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *pickleMachine) pop() (interface{}, error) {
+	if len(m.stack) == 0 {
+		return nil, errPickleMalformed
+	}
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v, nil
+}
+
+func (m *pickleMachine) top() (interface{}, error) {
+	if len(m.stack) == 0 {
+		return nil, errPickleMalformed
+	}
+	return m.stack[len(m.stack)-1], nil
+}
+
+// popMark returns the items pushed since the last MARK
+func (m *pickleMachine) popMark() ([]interface{}, error) {
+	for i := len(m.stack) - 1; i >= 0; i-- {
+		if _, ok := m.stack[i].(pickleMark); ok {
+			items := make([]interface{}, len(m.stack)-i-1)
+			copy(items, m.stack[i+1:])
+			m.stack = m.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errPickleMalformed
+}
+
+func (m *pickleMachine) appendTo(items ...interface{}) error {
+	if len(m.stack) == 0 {
+		return errPickleMalformed
+	}
+	list, ok := m.stack[len(m.stack)-1].(*pickleList)
+	if !ok {
+		return errPickleMalformed
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (m *pickleMachine) memoize(key int) error {
+	v, err := m.top()
+	if err != nil {
+		return err
+	}
+	m.memo[key] = v
+	return nil
+}
+
+func (m *pickleMachine) recall(key int) error {
+	v, ok := m.memo[key]
+	if !ok {
+		return errPickleMalformed
+	}
+	m.push(v)
+	return nil
+}
+
+func (m *pickleMachine) tuple(n int) error {
+	if len(m.stack) < n {
+		return errPickleMalformed
+	}
+	t := make(pickleTuple, n)
+	copy(t, m.stack[len(m.stack)-n:])
+	m.stack = m.stack[:len(m.stack)-n]
+	m.push(t)
+	return nil
+}
+
+func decodeLong(b []byte) interface{} {
+	if len(b) <= 8 {
+		var v int64
+		for i := len(b) - 1; i >= 0; i-- {
+			v = v<<8 | int64(b[i])
+		}
+		if len(b) > 0 && len(b) < 8 && b[len(b)-1]&0x80 != 0 {
+			v -= int64(1) << (8 * uint(len(b)))
+		}
+		return v
+	}
+	// little-endian two's complement, larger than int64
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	f, _ := new(big.Float).SetInt(v).Float64()
+	return f
+}
+
+func (m *pickleMachine) run() (interface{}, error) {
+	for m.pos < len(m.data) {
+		op := m.data[m.pos]
+		m.pos++
+		switch op {
+		case '.': // STOP
+			return m.pop()
+		case 0x80: // PROTO
+			if _, err := m.read(1); err != nil {
+				return nil, err
+			}
+		case 0x95: // FRAME
+			if _, err := m.read(8); err != nil {
+				return nil, err
+			}
+		case '(': // MARK
+			m.push(pickleMark{})
+		case '0': // POP
+			if _, err := m.pop(); err != nil {
+				return nil, err
+			}
+		case '1': // POP_MARK
+			if _, err := m.popMark(); err != nil {
+				return nil, err
+			}
+		case '2': // DUP
+			v, err := m.top()
+			if err != nil {
+				return nil, err
+			}
+			m.push(v)
+		case 'N':
+			m.push(nil)
+		case 0x88:
+			m.push(true)
+		case 0x89:
+			m.push(false)
+		case 'I', 'L': // INT, LONG (text)
+			line, err := m.readLine()
+			if err != nil {
+				return nil, err
+			}
+			s := strings.TrimSuffix(string(line), "L")
+			switch s {
+			case "00":
+				m.push(false)
+			case "01":
+				m.push(true)
+			default:
+				v, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					f, ferr := strconv.ParseFloat(s, 64)
+					if ferr != nil {
+						return nil, errPickleMalformed
+					}
+					m.push(f)
+				} else {
+					m.push(v)
+				}
+			}
+		case 'F': // FLOAT (text)
+			line, err := m.readLine()
+			if err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseFloat(string(line), 64)
+			if err != nil {
+				return nil, errPickleMalformed
+			}
+			m.push(v)
+		case 'J': // BININT
+			b, err := m.read(4)
+			if err != nil {
+				return nil, err
+			}
+			m.push(int64(int32(binary.LittleEndian.Uint32(b))))
+		case 'K': // BININT1
+			b, err := m.read(1)
+			if err != nil {
+				return nil, err
+			}
+			m.push(int64(b[0]))
+		case 'M': // BININT2
+			b, err := m.read(2)
+			if err != nil {
+				return nil, err
+			}
+			m.push(int64(binary.LittleEndian.Uint16(b)))
+		case 0x8a: // LONG1
+			n, err := m.read(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := m.read(int(n[0]))
+			if err != nil {
+				return nil, err
+			}
+			m.push(decodeLong(b))
+		case 0x8b: // LONG4
+			n, err := m.read(4)
+			if err != nil {
+				return nil, err
+			}
+			b, err := m.read(int(int32(binary.LittleEndian.Uint32(n))))
+			if err != nil {
+				return nil, err
+			}
+			m.push(decodeLong(b))
+		case 'G': // BINFLOAT
+			b, err := m.read(8)
+			if err != nil {
+				return nil, err
+			}
+			m.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case 'S': // STRING (quoted repr)
+			line, err := m.readLine()
+			if err != nil {
+				return nil, err
+			}
+			s, err := strconv.Unquote(string(line))
+			if err != nil {
+				if len(line) < 2 {
+					return nil, errPickleMalformed
+				}
+				s = string(line[1 : len(line)-1])
+			}
+			m.push(s)
+		case 'V': // UNICODE (raw-unicode-escape)
+			line, err := m.readLine()
+			if err != nil {
+				return nil, err
+			}
+			m.push(string(line))
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			n, err := m.read(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := m.read(int(n[0]))
+			if err != nil {
+				return nil, err
+			}
+			m.push(string(b))
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			n, err := m.read(4)
+			if err != nil {
+				return nil, err
+			}
+			b, err := m.read(int(binary.LittleEndian.Uint32(n)))
+			if err != nil {
+				return nil, err
+			}
+			m.push(string(b))
+		case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+			n, err := m.read(8)
+			if err != nil {
+				return nil, err
+			}
+			size := binary.LittleEndian.Uint64(n)
+			if size > uint64(len(m.data)) {
+				return nil, errPickleMalformed
+			}
+			b, err := m.read(int(size))
+			if err != nil {
+				return nil, err
+			}
+			m.push(string(b))
+		case ']': // EMPTY_LIST
+			m.push(&pickleList{})
+		case 'l': // LIST
+			items, err := m.popMark()
+			if err != nil {
+				return nil, err
+			}
+			m.push(&pickleList{items: items})
+		case 'a': // APPEND
+			v, err := m.pop()
+			if err != nil {
+				return nil, err
+			}
+			if err := m.appendTo(v); err != nil {
+				return nil, err
+			}
+		case 'e': // APPENDS
+			items, err := m.popMark()
+			if err != nil {
+				return nil, err
+			}
+			if err := m.appendTo(items...); err != nil {
+				return nil, err
+			}
+		case ')': // EMPTY_TUPLE
+			m.push(pickleTuple{})
+		case 't': // TUPLE
+			items, err := m.popMark()
+			if err != nil {
+				return nil, err
+			}
+			m.push(pickleTuple(items))
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			if err := m.tuple(int(op - 0x84)); err != nil {
+				return nil, err
+			}
+		case 'p': // PUT
+			line, err := m.readLine()
+			if err != nil {
+				return nil, err
+			}
+			key, err := strconv.Atoi(string(line))
+			if err != nil {
+				return nil, errPickleMalformed
+			}
+			if err := m.memoize(key); err != nil {
+				return nil, err
+			}
+		case 'q': // BINPUT
+			b, err := m.read(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.memoize(int(b[0])); err != nil {
+				return nil, err
+			}
+		case 'r': // LONG_BINPUT
+			b, err := m.read(4)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.memoize(int(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+		case 0x94: // MEMOIZE
+			if err := m.memoize(len(m.memo)); err != nil {
+				return nil, err
+			}
+		case 'g': // GET
+			line, err := m.readLine()
+			if err != nil {
+				return nil, err
+			}
+			key, err := strconv.Atoi(string(line))
+			if err != nil {
+				return nil, errPickleMalformed
+			}
+			if err := m.recall(key); err != nil {
+				return nil, err
+			}
+		case 'h': // BINGET
+			b, err := m.read(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.recall(int(b[0])); err != nil {
+				return nil, err
+			}
+		case 'j': // LONG_BINGET
+			b, err := m.read(4)
+			if err != nil {
+				return nil, err
+			}
+			if err := m.recall(int(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errPickleUnsupported
+		}
+	}
+	return nil, errPickleMalformed
+}
+
+func pickleItems(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case *pickleList:
+		return t.items, true
+	case pickleTuple:
+		return t, true
+	}
+	return nil, false
+}
+
+func pickleFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	case bool:
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// ParsePickleGraphiteProtocol decodes a single frame payload (without the
+// length prefix), a list of (path, (timestamp, value)).
+func ParsePickleGraphiteProtocol(payload []byte) ([]DataPoint, error) {
+	m := &pickleMachine{data: payload, memo: make(map[int]interface{})}
+	obj, err := m.run()
+	if err != nil {
+		return nil, err
+	}
+	items, ok := pickleItems(obj)
+	if !ok {
+		return nil, errPickleMalformed
+	}
+
+	result := make([]DataPoint, 0, len(items))
+	for _, item := range items {
+		pair, ok := pickleItems(item)
+		if !ok || len(pair) != 2 {
+			return result, errPickleMalformed
+		}
+		metric, ok := pair[0].(string)
+		if !ok || metric == "" {
+			return result, errPickleMalformed
+		}
+		point, ok := pickleItems(pair[1])
+		if !ok || len(point) != 2 {
+			return result, errPickleMalformed
+		}
+		ts, okTs := pickleFloat(point[0])
+		value, okValue := pickleFloat(point[1])
+		if !okTs || !okValue || math.IsNaN(value) || math.IsNaN(ts) {
+			return result, errPickleMalformed
+		}
+		dp, err := NewDataPoint(metric, value, int64(ts))
+		if err != nil {
+			return result, err
+		}
+		result = append(result, dp)
+	}
+	return result, nil
+}
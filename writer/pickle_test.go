@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParsePickleGraphiteProtocol(t *testing.T) {
+	// pickle.dumps([('a.b', (1700000000, 1.5)), ('c.d', (1700000001, 2))], protocol=N)
+	expected := []DataPoint{
+		{Metric: "a.b", Value: 1.5, Timestamp: 1700000000},
+		{Metric: "c.d", Value: 2, Timestamp: 1700000001},
+	}
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"protocol 0", "(lp0\n(Va.b\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vc.d\np4\n(I1700000001\nI2\ntp5\ntp6\na."},
+		{"protocol 1", "]q\x00((X\x03\x00\x00\x00a.bq\x01(J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x03\x00\x00\x00c.dq\x04(J\x01\xf1SeK\x02tq\x05tq\x06e."},
+		{"protocol 2", "\x80\x02]q\x00(X\x03\x00\x00\x00a.bq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00c.dq\x04J\x01\xf1SeK\x02\x86q\x05\x86q\x06e."},
+		{"protocol 3", "\x80\x03]q\x00(X\x03\x00\x00\x00a.bq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00c.dq\x04J\x01\xf1SeK\x02\x86q\x05\x86q\x06e."},
+		{"protocol 4", "\x80\x04\x95.\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x03a.b\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x03c.d\x94J\x01\xf1SeK\x02\x86\x94\x86\x94e."},
+		// the list is memoized empty, filled, popped and recalled
+		{"memoized list", "\x80\x02]q\x00(X\x03\x00\x00\x00a.bJ\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x86X\x03\x00\x00\x00c.dJ\x01\xf1SeK\x02\x86\x86e0h\x00."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dps, err := ParsePickleGraphiteProtocol([]byte(test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(dps, expected) {
+				t.Fatalf("got %+v, expected %+v", dps, expected)
+			}
+		})
+	}
+}
+
+func TestParsePickleGraphiteProtocolRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     error
+	}{
+		{"global", "cos\nsystem\n(S'id'\ntR.", errPickleUnsupported},
+		{"reduce", "\x80\x02]q\x00(K\x01K\x02\x86R.", errPickleUnsupported},
+		{"build", "\x80\x02]q\x00}b.", errPickleUnsupported},
+		{"stack_global", "\x80\x04\x8c\x02os\x8c\x06system\x93.", errPickleUnsupported},
+		{"truncated", "\x80\x02]q\x00(X\x03\x00\x00\x00a.", errPickleMalformed},
+		{"no stop", "\x80\x02]q\x00", errPickleMalformed},
+		{"unknown memo", "\x80\x02h\x05.", errPickleMalformed},
+		{"not a list", "\x80\x02K\x01.", errPickleMalformed},
+		{"bad pair", "\x80\x02]q\x00X\x03\x00\x00\x00a.ba.", errPickleMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParsePickleGraphiteProtocol([]byte(test.payload))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// prometheus
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errBadProtobuf = errors.New("bad_protobuf")
+
+type promSample struct {
+	Value     float64
+	Timestamp int64 // milliseconds
+}
+
+type prometheusMapping struct {
+	match    *regexp.Regexp
+	tagged   bool
+	template *PathTemplate
+}
+
+// PrometheusMapper names prometheus series (metric name plus labels) either
+// as dotted graphite paths or as tagged series.
+type PrometheusMapper struct {
+	prefix   string
+	mappings []prometheusMapping
+}
+
+// Map returns name and tags for the series, false when no mapping selects it
+func (m *PrometheusMapper) Map(labels map[string]string) (string, map[string]string, bool) {
+	name := labels["__name__"]
+	if name == "" {
+		return "", nil, false
+	}
+	for _, mapping := range m.mappings {
+		if mapping.match != nil && !mapping.match.MatchString(name) {
+			continue
+		}
+		if mapping.tagged {
+			return m.prefix + SanitizeSegment(name), TagsFromLabels(labels, "__name__"), true
+		}
+		path := mapping.template.Render(labels)
+		if path == "" {
+			return "", nil, false
+		}
+		return m.prefix + path, nil, true
+	}
+	return "", nil, false
+}
+
+// NewPrometheusMapper compiles mappings, without any mapping every series is
+// kept as a tagged series.
+func NewPrometheusMapper(prefix string, configs []PrometheusMappingConfig) (*PrometheusMapper, error) {
+	m := &PrometheusMapper{}
+	if prefix != "" {
+		m.prefix = prefix + "."
+	}
+	if len(configs) == 0 {
+		m.mappings = []prometheusMapping{{tagged: true}}
+	}
+	for _, config := range configs {
+		mapping := prometheusMapping{tagged: config.Tagged}
+		if config.Match != "" {
+			re, err := regexp.Compile(config.Match)
+			if err != nil {
+				return nil, err
+			}
+			mapping.match = re
+		}
+		if config.Template == "" {
+			config.Template = "{__name__}"
+		}
+		mapping.template = NewPathTemplate(config.Template)
+		m.mappings = append(m.mappings, mapping)
+	}
+	return m, nil
+}
+
+func parsePromLabel(b []byte) (string, string, error) {
+	var name, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", errBadProtobuf
+		}
+		b = b[n:]
+		if typ == protowire.BytesType && (num == 1 || num == 2) {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return "", "", errBadProtobuf
+			}
+			if num == 1 {
+				name = string(v)
+			} else {
+				value = string(v)
+			}
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return "", "", errBadProtobuf
+		}
+		b = b[n:]
+	}
+	return name, value, nil
+}
+
+func parsePromSample(b []byte) (promSample, error) {
+	var sample promSample
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return sample, errBadProtobuf
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return sample, errBadProtobuf
+			}
+			sample.Value = math.Float64frombits(v)
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return sample, errBadProtobuf
+			}
+			sample.Timestamp = int64(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return sample, errBadProtobuf
+			}
+			b = b[n:]
+		}
+	}
+	return sample, nil
+}
+
+func parsePromTimeSeries(b []byte) (map[string]string, []promSample, error) {
+	labels := make(map[string]string)
+	var samples []promSample
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, nil, errBadProtobuf
+		}
+		b = b[n:]
+		if typ == protowire.BytesType && (num == 1 || num == 2) {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, nil, errBadProtobuf
+			}
+			b = b[n:]
+			if num == 1 {
+				name, value, err := parsePromLabel(v)
+				if err != nil {
+					return nil, nil, err
+				}
+				labels[name] = value
+			} else {
+				sample, err := parsePromSample(v)
+				if err != nil {
+					return nil, nil, err
+				}
+				samples = append(samples, sample)
+			}
+			continue
+		}
+		// exemplars, native histograms
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, nil, errBadProtobuf
+		}
+		b = b[n:]
+	}
+	return labels, samples, nil
+}
+
+// ParseRemoteWrite decodes an uncompressed prometheus.WriteRequest protobuf,
+// onSeries is called for every time series, metadata is ignored.
+func ParseRemoteWrite(b []byte, onSeries func(labels map[string]string, samples []promSample)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBadProtobuf
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return errBadProtobuf
+			}
+			b = b[n:]
+			labels, samples, err := parsePromTimeSeries(v)
+			if err != nil {
+				return err
+			}
+			onSeries(labels, samples)
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return errBadProtobuf
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// PrometheusReceiver implements the remote_write endpoint on the shared HTTP server
+type PrometheusReceiver struct {
+	server *HTTPServer
+	mapper *PrometheusMapper
+	stats  *Stats
+	bus    *Bus
+}
+
+func (p *PrometheusReceiver) remoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		p.server.fail(w, http.StatusMethodNotAllowed, errors.New("method_not_allowed"))
+		return
+	}
+	p.stats.Record("prometheus", "requests")
+	body, err := p.server.readBody(w, r)
+	if err != nil {
+		p.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var accepted, rejected, dropped int64
+	err = ParseRemoteWrite(body, func(labels map[string]string, samples []promSample) {
+		name, tags, ok := p.mapper.Map(labels)
+		if !ok {
+			dropped += int64(len(samples))
+			return
+		}
+		for _, sample := range samples {
+			// NaN is also used as the staleness marker
+			if math.IsNaN(sample.Value) {
+				rejected++
+				continue
+			}
+			dp := NewTaggedDataPoint(name, tags, sample.Value, sample.Timestamp/1000)
+			p.bus.Emit(&dp)
+			accepted++
+		}
+	})
+	p.stats.Record("prometheus", "samples", accepted)
+	p.stats.Record("prometheus", "rejected", rejected)
+	p.stats.Record("prometheus", "dropped", dropped)
+	if err != nil {
+		p.stats.Record("parser.errors", err.Error())
+		p.server.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func NewPrometheusReceiver(config *PrometheusConfig, server *HTTPServer, stats *Stats, bus *Bus) (*PrometheusReceiver, error) {
+	mapper, err := NewPrometheusMapper(config.Prefix, config.Mappings)
+	if err != nil {
+		return nil, err
+	}
+	if config.Path == "" {
+		config.Path = "/api/v1/write"
+	}
+	p := &PrometheusReceiver{server: server, mapper: mapper, stats: stats, bus: bus}
+	server.Handle(config.Path, p.remoteWrite)
+	log.Info("Prometheus remote_write enabled on ", config.Path)
+	return p, nil
+}
@@ -0,0 +1,129 @@
+// proxy
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol, https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyV1MaxLength    = 107
+	proxyV2HeaderLength = 16
+)
+
+var (
+	errProxyIncomplete = errors.New("proxy_incomplete")
+	errBadProxyHeader  = errors.New("bad_proxy_header")
+)
+
+// ParseProxyHeader reads a PROXY protocol v1 or v2 header at the start of buf
+// and returns its length and the source address. The address is nil for
+// LOCAL (v2) and UNKNOWN (v1) connections, e.g. health checks of the
+// balancer, errProxyIncomplete means more data is needed.
+func ParseProxyHeader(buf []byte) (int, net.Addr, error) {
+	switch {
+	case bytes.HasPrefix(buf, proxyV2Signature):
+		return parseProxyV2(buf)
+	case bytes.HasPrefix(buf, proxyV1Signature):
+		return parseProxyV1(buf)
+	case bytes.HasPrefix(proxyV2Signature, buf), bytes.HasPrefix(proxyV1Signature, buf):
+		return 0, nil, errProxyIncomplete
+	}
+	return 0, nil, errBadProxyHeader
+}
+
+// parseProxyV1 handles `PROXY TCP4|TCP6 <src> <dst> <sport> <dport>\r\n`
+func parseProxyV1(buf []byte) (int, net.Addr, error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) < proxyV1MaxLength {
+			return 0, nil, errProxyIncomplete
+		}
+		return 0, nil, errBadProxyHeader
+	}
+	if end+2 > proxyV1MaxLength {
+		return 0, nil, errBadProxyHeader
+	}
+	fields := strings.Split(string(buf[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return end + 2, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return 0, nil, errBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return 0, nil, errBadProxyHeader
+	}
+	return end + 2, &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 handles the binary header, TLVs are skipped
+func parseProxyV2(buf []byte) (int, net.Addr, error) {
+	if len(buf) < proxyV2HeaderLength {
+		return 0, nil, errProxyIncomplete
+	}
+	command, family := buf[12], buf[13]
+	if command>>4 != 2 {
+		return 0, nil, errBadProxyHeader
+	}
+	total := proxyV2HeaderLength + int(binary.BigEndian.Uint16(buf[14:16]))
+	if len(buf) < total {
+		return 0, nil, errProxyIncomplete
+	}
+	switch command & 0x0f {
+	case 0x0: // LOCAL
+		return total, nil, nil
+	case 0x1: // PROXY
+	default:
+		return 0, nil, errBadProxyHeader
+	}
+
+	addrs := buf[proxyV2HeaderLength:total]
+	switch family >> 4 {
+	case 0x1: // AF_INET, src, dst, sport, dport
+		if len(addrs) < 12 {
+			return 0, nil, errBadProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), addrs[:4]...))
+		return total, &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case 0x2: // AF_INET6
+		if len(addrs) < 36 {
+			return 0, nil, errBadProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), addrs[:16]...))
+		return total, &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	}
+	// AF_UNSPEC and AF_UNIX carry nothing useful
+	return total, nil, nil
+}
+
+// clientHost is the address of a client without the (ephemeral) port
+func clientHost(addr net.Addr) string {
+	switch a := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
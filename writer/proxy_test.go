@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name   string
+		header string
+		length int
+		source string
+		err    error
+	}{
+		{"v1 tcp4", "PROXY TCP4 10.1.1.1 10.0.0.1 5555 2003\r\nmetric 1 1\n", 40, "10.1.1.1:5555", nil},
+		{"v1 tcp6", "PROXY TCP6 ::1 ::2 5555 2003\r\n", 30, "[::1]:5555", nil},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", 15, "", nil},
+		{"v1 partial signature", "PRO", 0, "", errProxyIncomplete},
+		{"v1 no crlf", "PROXY TCP4 10.1.1.1 10.0.0.1", 0, "", errProxyIncomplete},
+		{"v1 too long", "PROXY TCP4 " + string(make([]byte, 120)), 0, "", errBadProxyHeader},
+		{"v1 bad protocol", "PROXY UDP4 10.1.1.1 10.0.0.1 5555 2003\r\n", 0, "", errBadProxyHeader},
+		{"v1 missing field", "PROXY TCP4 10.1.1.1 10.0.0.1 5555\r\n", 0, "", errBadProxyHeader},
+		{"v1 bad address", "PROXY TCP4 10.1.1 10.0.0.1 5555 2003\r\n", 0, "", errBadProxyHeader},
+		{"v1 family mismatch", "PROXY TCP4 ::1 ::2 5555 2003\r\n", 0, "", errBadProxyHeader},
+		{"v1 bad port", "PROXY TCP4 10.1.1.1 10.0.0.1 70000 2003\r\n", 0, "", errBadProxyHeader},
+		{"v2 tcp4", v2 + "\x21\x11\x00\x0c\x0a\x01\x01\x01\x0a\x00\x00\x01\x15\xb3\x07\xd3", 28, "10.1.1.1:5555", nil},
+		{"v2 tcp4 with tlv", v2 + "\x21\x11\x00\x10\x0a\x01\x01\x01\x0a\x00\x00\x01\x15\xb3\x07\xd3\x04\x00\x01\x00", 32, "10.1.1.1:5555", nil},
+		{"v2 tcp6", v2 + "\x21\x21\x00\x24" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" + "\x15\xb3\x07\xd3", 52, "[::1]:5555", nil},
+		{"v2 local", v2 + "\x20\x00\x00\x00", 16, "", nil},
+		{"v2 unspec", v2 + "\x21\x00\x00\x00", 16, "", nil},
+		{"v2 partial signature", v2[:5], 0, "", errProxyIncomplete},
+		{"v2 partial header", v2 + "\x21\x11", 0, "", errProxyIncomplete},
+		{"v2 partial addresses", v2 + "\x21\x11\x00\x0c\x0a\x01", 0, "", errProxyIncomplete},
+		{"v2 bad version", v2 + "\x11\x11\x00\x0c\x0a\x01\x01\x01\x0a\x00\x00\x01\x15\xb3\x07\xd3", 0, "", errBadProxyHeader},
+		{"v2 bad command", v2 + "\x22\x11\x00\x0c\x0a\x01\x01\x01\x0a\x00\x00\x01\x15\xb3\x07\xd3", 0, "", errBadProxyHeader},
+		{"v2 short addresses", v2 + "\x21\x11\x00\x04\x0a\x01\x01\x01", 0, "", errBadProxyHeader},
+		{"no header", "metric 1 1\n", 0, "", errBadProxyHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			length, addr, err := ParseProxyHeader([]byte(test.header))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if length != test.length {
+				t.Errorf("got length %d, expected %d", length, test.length)
+			}
+			source := ""
+			if addr != nil {
+				source = addr.String()
+			}
+			if source != test.source {
+				t.Errorf("got source %q, expected %q", source, test.source)
+			}
+		})
+	}
+}
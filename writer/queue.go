@@ -0,0 +1,103 @@
+// queue
+package main
+
+import (
+	"sync"
+	"time"
+
+	lane "github.com/oleiade/lane/v2"
+)
+
+// overflow policies of a bounded queue
+const (
+	OverflowDropNewest = "drop-newest"
+	OverflowDropOldest = "drop-oldest"
+	OverflowBlock      = "block"
+)
+
+// busQueue is a FIFO of datapoints, bounded when capacity is set. With the
+// block policy Enqueue waits for space, called from a gnet event loop it
+// stops reads of all its connections so TCP backpressure reaches senders.
+type busQueue struct {
+	sync.Mutex
+	notFull  *sync.Cond
+	notEmpty *sync.Cond
+	items    *lane.Deque[*DataPoint]
+	capacity uint
+	policy   string
+	closed   bool // consumers leave once it is empty, producers stop waiting
+}
+
+// Enqueue returns the datapoint dropped to keep the capacity, if any, and
+// how long it waited for space
+func (q *busQueue) Enqueue(datapoint *DataPoint) (*DataPoint, time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	var dropped *DataPoint
+	var waited time.Duration
+	if q.capacity > 0 && q.items.Size() >= q.capacity {
+		switch q.policy {
+		case OverflowDropOldest:
+			dropped, _ = q.items.Shift()
+		case OverflowBlock:
+			start := time.Now()
+			for q.items.Size() >= q.capacity && !q.closed {
+				q.notFull.Wait()
+			}
+			waited = time.Since(start)
+		default:
+			return datapoint, 0
+		}
+	}
+	q.items.Append(datapoint)
+	q.notEmpty.Signal()
+	return dropped, waited
+}
+
+// Dequeue does not wait, ok is false when the queue is empty
+func (q *busQueue) Dequeue() (*DataPoint, bool) {
+	q.Lock()
+	defer q.Unlock()
+	return q.shift()
+}
+
+// Wait dequeues the next datapoint, ok is false once the queue is closed
+// and empty
+func (q *busQueue) Wait() (*DataPoint, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for q.items.Size() == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	return q.shift()
+}
+
+func (q *busQueue) shift() (*DataPoint, bool) {
+	datapoint, ok := q.items.Shift()
+	if ok && q.policy == OverflowBlock {
+		q.notFull.Signal()
+	}
+	return datapoint, ok
+}
+
+func (q *busQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *busQueue) Size() uint {
+	return q.items.Size()
+}
+
+func newBusQueue(capacity int, policy string) *busQueue {
+	q := &busQueue{items: lane.NewDeque[*DataPoint](), policy: policy}
+	if capacity > 0 {
+		q.capacity = uint(capacity)
+	}
+	q.notFull = sync.NewCond(q)
+	q.notEmpty = sync.NewCond(q)
+	return q
+}
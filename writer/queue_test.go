@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		dropped  string   // returned by the enqueue of c
+		expected []string // queued afterwards
+	}{
+		{"drop newest", OverflowDropNewest, "c", []string{"a", "b"}},
+		{"drop oldest", OverflowDropOldest, "a", []string{"b", "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newBusQueue(2, test.policy)
+			for _, metric := range []string{"a", "b"} {
+				if dropped, _ := q.Enqueue(&DataPoint{Metric: metric}); dropped != nil {
+					t.Fatalf("%s dropped below the capacity", dropped.Metric)
+				}
+			}
+			dropped, waited := q.Enqueue(&DataPoint{Metric: "c"})
+			if dropped == nil || dropped.Metric != test.dropped || waited != 0 {
+				t.Fatalf("got %v dropped after %s, expected %s", dropped, waited, test.dropped)
+			}
+			if q.Size() != 2 {
+				t.Fatalf("got size %d, expected 2", q.Size())
+			}
+			for _, metric := range test.expected {
+				if datapoint, ok := q.Dequeue(); !ok || datapoint.Metric != metric {
+					t.Fatalf("got %v, expected %s", datapoint, metric)
+				}
+			}
+		})
+	}
+}
+
+func TestBusQueueBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(q *busQueue)
+		queued  int // once released
+	}{
+		{"until dequeued", func(q *busQueue) { q.Dequeue() }, 2},
+		{"until closed", func(q *busQueue) { q.Close() }, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newBusQueue(2, OverflowBlock)
+			q.Enqueue(&DataPoint{Metric: "a"})
+			q.Enqueue(&DataPoint{Metric: "b"})
+			type result struct {
+				dropped *DataPoint
+				waited  time.Duration
+			}
+			done := make(chan result)
+			go func() {
+				dropped, waited := q.Enqueue(&DataPoint{Metric: "c"})
+				done <- result{dropped, waited}
+			}()
+			select {
+			case <-done:
+				t.Fatal("enqueued into a full queue")
+			case <-time.After(50 * time.Millisecond):
+			}
+			test.release(q)
+			select {
+			case r := <-done:
+				if r.dropped != nil || r.waited < 50*time.Millisecond {
+					t.Fatalf("got %v dropped after waiting %s", r.dropped, r.waited)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("still waiting once released")
+			}
+			if int(q.Size()) != test.queued {
+				t.Fatalf("got size %d, expected %d", q.Size(), test.queued)
+			}
+		})
+	}
+}
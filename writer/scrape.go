@@ -0,0 +1,372 @@
+// scrape
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// MaxScrapeSize limits the exposition body of a single scrape
+const MaxScrapeSize = 64 << 20
+
+var errBadLabels = errors.New("bad_labels")
+
+var promLabelUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+
+// parsePromLabels parses `{name="value",...}` returning the remainder
+func parsePromLabels(s string, labels map[string]string) (string, error) {
+	s = strings.TrimLeft(s[1:], " ")
+	for {
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 1 || len(s) < eq+2 || s[eq+1] != '"' {
+			return "", errBadLabels
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+2:]
+		end := -1
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return "", errBadLabels
+		}
+		labels[name] = promLabelUnescaper.Replace(s[:end])
+		s = strings.TrimLeft(s[end+1:], " ")
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimLeft(s[1:], " ")
+		}
+	}
+}
+
+// ParsePromTextLine parses a sample line of the prometheus text exposition
+// format, `name{label="value",...} value [timestamp_ms]`
+func ParsePromTextLine(line string) (map[string]string, float64, int64, error) {
+	labels := make(map[string]string)
+	end := strings.IndexAny(line, "{ \t")
+	if end < 1 {
+		return nil, 0, 0, errBadMessage
+	}
+	labels["__name__"] = line[:end]
+	rest := line[end:]
+	if rest[0] == '{' {
+		var err error
+		if rest, err = parsePromLabels(rest, labels); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, 0, 0, errBadMessage
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, 0, 0, errBadValue
+	}
+	var ts int64
+	if len(fields) == 2 {
+		if ts, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, 0, 0, errBadTimestamp
+		}
+	}
+	return labels, value, ts, nil
+}
+
+// scrapeTarget is a single endpoint scraped by its own goroutine
+type scrapeTarget struct {
+	job    *scrapeJob
+	url    string
+	unit   string // stats unit, scrape.<job>.<host:port>
+	labels map[string]string
+	stop   chan struct{}
+}
+
+type scrapeJob struct {
+	config   *ScrapeJobConfig
+	mapper   *PrometheusMapper
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// targets returns static and file discovered targets keyed by URL
+func (job *scrapeJob) targets() map[string]map[string]string {
+	targets := make(map[string]map[string]string)
+	add := func(hostport string, labels map[string]string) {
+		merged := map[string]string{"job": job.config.Name, "instance": hostport}
+		for k, v := range job.config.Labels {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		targets[job.config.Scheme+"://"+hostport+job.config.Path] = merged
+	}
+	for _, target := range job.config.Targets {
+		add(target, nil)
+	}
+	for _, pattern := range job.config.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Warn("Invalid scrape file pattern ", pattern, ": ", err)
+			continue
+		}
+		for _, file := range files {
+			groups, err := loadScrapeFile(file)
+			if err != nil {
+				log.Warn("Cannot load scrape targets from ", file, ": ", err)
+				continue
+			}
+			for _, group := range groups {
+				for _, target := range group.Targets {
+					add(target, group.Labels)
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// scrapeFileGroup follows the prometheus file_sd format, JSON or YAML
+type scrapeFileGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+func loadScrapeFile(path string) ([]scrapeFileGroup, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []scrapeFileGroup
+	// JSON is valid YAML
+	err = yaml.Unmarshal(content, &groups)
+	return groups, err
+}
+
+// ScrapeManager pulls prometheus text exposition from configured targets
+// and emits the samples, target health is kept in stats under scrape.<job>.
+type ScrapeManager struct {
+	sync.Mutex
+
+	jobs    []*scrapeJob
+	refresh time.Duration
+	client  *http.Client
+	targets map[string]*scrapeTarget
+	wg      sync.WaitGroup
+	done    chan struct{}
+	stats   *Stats
+	bus     *Bus
+}
+
+func (m *ScrapeManager) scrape(target *scrapeTarget) error {
+	job := target.job
+	ctx, cancel := context.WithTimeout(context.Background(), job.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(job.timeout.Seconds(), 'f', -1, 64))
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	now := time.Now().Unix()
+	var samples, rejected int64
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, MaxScrapeSize))
+	scanner.Buffer(make([]byte, 0, 64*1024), DefaultMaxLineLength*4)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		labels, value, ts, err := ParsePromTextLine(string(line))
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			rejected++
+			continue
+		}
+		// target labels win over exposed ones
+		for k, v := range target.labels {
+			labels[k] = v
+		}
+		name, tags, ok := job.mapper.Map(labels)
+		if !ok {
+			continue
+		}
+		if ts > 0 {
+			ts /= 1000
+		} else {
+			ts = now
+		}
+		dp := NewTaggedDataPoint(name, tags, value, ts)
+		m.bus.Emit(&dp)
+		samples++
+	}
+	m.stats.RecordFixed(target.unit, "samples", samples)
+	m.stats.Record(target.unit, "rejected", rejected)
+	return scanner.Err()
+}
+
+func (m *ScrapeManager) run(target *scrapeTarget) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(target.job.interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		if err := m.scrape(target); err != nil {
+			m.stats.RecordFixed(target.unit, "up", 0)
+			m.stats.Record(target.unit, "errors")
+			log.Debug("Scrape of ", target.url, " failed: ", err)
+		} else {
+			m.stats.RecordFixed(target.unit, "up", 1)
+		}
+		m.stats.RecordFixed(target.unit, "duration_ms", time.Since(start).Milliseconds())
+		select {
+		case <-ticker.C:
+		case <-target.stop:
+			return
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// sync starts new targets and stops vanished ones
+func (m *ScrapeManager) sync() {
+	m.Lock()
+	defer m.Unlock()
+	// Shutdown closes done under the lock, nothing is added to wg after it
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+	current := make(map[string]bool)
+	for _, job := range m.jobs {
+		for url, labels := range job.targets() {
+			key := job.config.Name + " " + url
+			current[key] = true
+			if _, ok := m.targets[key]; ok {
+				continue
+			}
+			target := &scrapeTarget{
+				job:    job,
+				url:    url,
+				unit:   "scrape." + SanitizeSegment(job.config.Name) + "." + SanitizeSegment(labels["instance"]),
+				labels: labels,
+				stop:   make(chan struct{}),
+			}
+			m.targets[key] = target
+			m.wg.Add(1)
+			go m.run(target)
+			log.Info("Scrape target added: ", url, " (", job.config.Name, ")")
+		}
+	}
+	for key, target := range m.targets {
+		if !current[key] {
+			close(target.stop)
+			delete(m.targets, key)
+			log.Info("Scrape target removed: ", target.url, " (", target.job.config.Name, ")")
+		}
+	}
+	m.stats.RecordFixed("scrape", "targets", int64(len(m.targets)))
+}
+
+func (m *ScrapeManager) Start() {
+	m.sync()
+	ticker := time.NewTicker(m.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sync()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Shutdown stops all targets and waits for in-flight scrapes
+func (m *ScrapeManager) Shutdown(ctx context.Context) {
+	log.Info("Shutting down scrape manager...")
+	m.Lock()
+	close(m.done)
+	m.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}
+
+func NewScrapeManager(config *ScrapeConfig, stats *Stats, bus *Bus) (*ScrapeManager, error) {
+	interval := ParseDurationWithFallback(config.Interval, time.Minute)
+	timeout := ParseDurationWithFallback(config.Timeout, 10*time.Second)
+	m := &ScrapeManager{
+		refresh: ParseDurationWithFallback(config.Refresh, time.Minute),
+		client:  &http.Client{},
+		targets: make(map[string]*scrapeTarget),
+		done:    make(chan struct{}),
+		stats:   stats,
+		bus:     bus,
+	}
+	for i := range config.Jobs {
+		jc := &config.Jobs[i]
+		if jc.Name == "" {
+			return nil, errors.New("scrape job without name")
+		}
+		if jc.Scheme == "" {
+			jc.Scheme = "http"
+		}
+		if jc.Path == "" {
+			jc.Path = "/metrics"
+		}
+		mapper, err := NewPrometheusMapper(jc.Prefix, jc.Mappings)
+		if err != nil {
+			return nil, err
+		}
+		job := &scrapeJob{config: jc, mapper: mapper, interval: interval, timeout: timeout}
+		if jc.Interval != "" {
+			job.interval = ParseDurationWithFallback(jc.Interval, interval)
+		}
+		if jc.Timeout != "" {
+			job.timeout = ParseDurationWithFallback(jc.Timeout, timeout)
+		}
+		m.jobs = append(m.jobs, job)
+	}
+	return m, nil
+}
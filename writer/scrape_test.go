@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScrapeManagerShutdown(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer exporter.Close()
+	target := strings.TrimPrefix(exporter.URL, "http://")
+
+	tests := []struct {
+		name    string
+		started bool // synced before the shutdown
+	}{
+		{"before the first sync", false},
+		{"with running targets", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus, drain := newRecordBus()
+			defer drain()
+			config := &ScrapeConfig{Interval: "10ms", Jobs: []ScrapeJobConfig{{Name: "node", Targets: []string{target}}}}
+			m, err := NewScrapeManager(config, NewStats(&StatsConfig{}, "test"), bus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.started {
+				m.sync()
+			}
+			// syncs racing the shutdown must not add targets once it started
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					m.sync()
+				}()
+			}
+			m.Shutdown(context.Background())
+			wg.Wait()
+
+			before := len(m.targets)
+			m.sync()
+			if len(m.targets) != before {
+				t.Fatalf("sync after shutdown changed targets from %d to %d", before, len(m.targets))
+			}
+		})
+	}
+}
@@ -1,49 +1,444 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/panjf2000/gnet/v2"
 )
 
+type IServer interface {
+	Start()
+	Shutdown(ctx context.Context)
+}
+
 type GosheniteServer struct {
 	gnet.BuiltinEventEngine
+	lineHandler
 
-	eng       gnet.Engine
-	addr      string
-	multicore bool
-	stats     *Stats
-	bus       *Bus
+	eng        gnet.Engine
+	protocol   string     // plain (line based), pickle, packet (binary datagrams)
+	network    string     // tcp, udp, unix
+	parse      LineParser // lines, or whole datagrams for packet
+	addr       string
+	multicore  bool
+	reuseport  bool
+	readBuffer int
+	config     *ListenerConfig
+	socketPath string      // unix only
+	socketMode os.FileMode // unix only
+	umask      int         // unix only, the umask to restore once bound
+	compressed bool        // connections are decompressed by a goroutine each
+	proxy      bool        // connections start with a PROXY protocol header
+	acl        *accessList // nil allows everyone
+	trusted    *accessList // peers allowed to send a PROXY header, nil when not restricted
+	open       int64       // currently open connections, atomic
+	idle       time.Duration
+	conns      sync.Map // gnet.Conn to *connState, tracked for the idle timeout only
 }
 
 func (server *GosheniteServer) OnBoot(eng gnet.Engine) gnet.Action {
 	server.eng = eng
+	if server.network == "unix" {
+		// the socket is bound, see Start
+		syscall.Umask(server.umask)
+		if err := os.Chmod(server.socketPath, server.socketMode); err != nil {
+			log.Error("Cannot set permissions of ", server.socketPath, ": ", err)
+		}
+	}
 	log.Info("Server started: listening on ", server.addr)
 	return gnet.None
 }
 
+// OnOpen enforces the connection limit, OnClose is called for rejected
+// connections as well
 func (server *GosheniteServer) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	server.stats.Record("tcp", "connections")
+	server.stats.Record(server.name, "connections")
+	state := &connState{client: c.RemoteAddr(), awaitProxy: server.proxy, active: time.Now().UnixNano()}
+	c.SetContext(state)
+	open := atomic.AddInt64(&server.open, 1)
+	if server.config.MaxConnections > 0 && open > int64(server.config.MaxConnections) {
+		server.stats.Record(server.name, "rejected.limit")
+		return nil, gnet.Close
+	}
+	if server.idle > 0 {
+		server.conns.Store(c, state)
+	}
+	if server.proxy && !server.trustedPeer(c.RemoteAddr()) {
+		return nil, gnet.Close
+	}
+	if !state.awaitProxy && !server.accept(c, state) {
+		return nil, gnet.Close
+	}
 	return nil, gnet.None
 }
 
+// trustedPeer checks the peer itself before its PROXY header is believed,
+// unless trusted proxies are listed it has to pass the access list as well
+func (server *GosheniteServer) trustedPeer(peer net.Addr) bool {
+	if server.trusted != nil {
+		if !server.trusted.allowed(peer) {
+			server.stats.Record(server.name, "rejected.proxy")
+			return false
+		}
+		return true
+	}
+	if !server.acl.allowed(peer) {
+		server.stats.Record(server.name, "rejected.acl")
+		return false
+	}
+	return true
+}
+
+// accept starts handling a connection once its client is known, returns
+// false when the client is not allowed
+func (server *GosheniteServer) accept(c gnet.Conn, state *connState) bool {
+	if !server.acl.allowed(state.client) {
+		server.stats.Record(server.name, "rejected.acl")
+		return false
+	}
+	if server.config.SourceStats {
+		state.source = server.sourceUnit(state.client)
+		server.stats.Record(state.source, "connections")
+	}
+	if server.compressed {
+		state.stream = newChunkStream(func() { c.Wake(nil) })
+		go server.decompress(state)
+	}
+	return true
+}
+
+func (server *GosheniteServer) sourceUnit(client net.Addr) string {
+	return server.name + ".source." + SanitizeSegment(clientHost(client))
+}
+
+// parseFrom parses lines of a client and accounts them to its source
+func (server *GosheniteServer) parseFrom(buf []byte, client net.Addr, source string) (int, int) {
+	accepted, rejected := server.parse(buf, client)
+	if source != "" {
+		server.stats.Record(source, "accepted", int64(accepted))
+		server.stats.Record(source, "rejected", int64(rejected))
+	}
+	return accepted, rejected
+}
+
+func (server *GosheniteServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	state, ok := c.Context().(*connState)
+	if !ok {
+		return gnet.None
+	}
+	atomic.AddInt64(&server.open, -1)
+	server.conns.Delete(c)
+	if state.stream != nil {
+		// the goroutine flushes the unfinished line
+		buf, _ := c.Peek(-1)
+		state.stream.close(buf)
+	} else if server.protocol == "plain" {
+		if lines := state.flush(); lines != nil {
+			server.parseFrom(lines, state.client, state.source)
+		}
+	}
+	return gnet.None
+}
+
+// OnTraffic records how long the event loop was kept from serving its other
+// connections
 func (server *GosheniteServer) OnTraffic(c gnet.Conn) gnet.Action {
+	start := time.Now()
+	action := server.onTraffic(c)
+	server.stats.Record(server.name, "eventloop.blocked_us", time.Since(start).Microseconds())
+	return action
+}
+
+func (server *GosheniteServer) onTraffic(c gnet.Conn) gnet.Action {
+	switch {
+	case server.protocol == "packet":
+		return server.onPacket(c)
+	case server.network == "udp":
+		return server.onDatagram(c)
+	}
+
+	state := c.Context().(*connState)
+	atomic.StoreInt64(&state.active, time.Now().UnixNano())
+	if state.awaitProxy {
+		action := server.onProxyHeader(c, state)
+		if action != gnet.None || state.awaitProxy || c.InboundBuffered() == 0 {
+			return action
+		}
+	}
+	switch {
+	case server.protocol == "pickle":
+		return server.onPickleTraffic(c, state)
+	case state.stream != nil:
+		return server.onCompressedTraffic(c, state)
+	default:
+		return server.onPlainTraffic(c, state)
+	}
+}
+
+// onProxyHeader consumes the PROXY protocol header, connections of the
+// balancer itself (LOCAL, UNKNOWN) keep their own address
+func (server *GosheniteServer) onProxyHeader(c gnet.Conn, state *connState) gnet.Action {
+	buf, _ := c.Peek(-1)
+	n, addr, err := ParseProxyHeader(buf)
+	if err == errProxyIncomplete {
+		return gnet.None
+	} else if err != nil {
+		server.stats.Record(server.name, "proxy.errors")
+		log.Debug("Invalid PROXY header from ", c.RemoteAddr())
+		return gnet.Close
+	}
+	c.Discard(n)
+	if addr != nil {
+		state.client = addr
+	}
+	state.awaitProxy = false
+	if !server.accept(c, state) {
+		return gnet.Close
+	}
+	return gnet.None
+}
+
+func (server *GosheniteServer) onPlainTraffic(c gnet.Conn, state *connState) gnet.Action {
 	buf, _ := c.Next(-1)
 
-	dps, err := ParsePlainGraphiteProtocol(buf)
-	if err != nil {
-		server.stats.Record("parser.errors", err.Error())
+	ok := state.feed(buf, server.config.MaxLineLength, func(lines []byte) {
+		server.parseFrom(lines, state.client, state.source)
+	})
+	if !ok {
+		server.stats.Record("parser.errors", "line_too_long")
 	}
+	return gnet.None
+}
 
-	for _, dp := range dps {
-		server.bus.Emit(&dp)
+// onCompressedTraffic passes the raw bytes on, the event loop never waits
+// for the decompressing goroutine. While it is behind the bytes stay in the
+// inbound buffer until it wakes the connection, a connection buffering more
+// than the backlog is closed.
+func (server *GosheniteServer) onCompressedTraffic(c gnet.Conn, state *connState) gnet.Action {
+	if atomic.LoadInt32(&state.stream.behind) == 1 {
+		if c.InboundBuffered() > server.config.Backlog {
+			dropped, _ := c.Discard(-1)
+			server.stats.Record(server.name, "compression.overflow")
+			server.stats.Record(server.name, "compression.dropped_bytes", int64(dropped))
+			log.Warn("Closing compressed stream from ", state.client, ", decompression is too far behind")
+			return gnet.Close
+		}
+		// no copies of the inbound buffer until woken
+		return gnet.None
+	}
+	buf, _ := c.Peek(-1)
+	if len(buf) == 0 {
+		return gnet.None
+	}
+	switch err := state.stream.push(buf); err {
+	case nil:
+		c.Discard(len(buf))
+	case errStreamBehind:
+	default:
+		return gnet.Close
 	}
 	return gnet.None
 }
 
+// decompress runs for the lifetime of a compressed connection
+func (server *GosheniteServer) decompress(state *connState) {
+	server.readStream(state.stream, server.config, func(lines []byte, client net.Addr) (int, int) {
+		return server.parseFrom(lines, client, state.source)
+	}, state.client)
+	state.stream.stop()
+}
+
+// onDatagram handles a single UDP datagram, the last line does not need
+// a trailing newline. Datagrams filling the whole read buffer were most
+// likely truncated by the kernel, so their last (partial) line is dropped.
+func (server *GosheniteServer) onDatagram(c gnet.Conn) gnet.Action {
+	buf, _ := c.Next(-1)
+	server.stats.Record(server.name, "datagrams")
+	if !server.acl.allowed(c.RemoteAddr()) {
+		server.stats.Record(server.name, "rejected.acl")
+		return gnet.None
+	}
+
+	if len(buf) >= server.readBuffer {
+		server.stats.Record(server.name, "truncated")
+		buf = buf[:bytes.LastIndexByte(buf, '\n')+1]
+	} else if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+
+	source := ""
+	if server.config.SourceStats {
+		source = server.sourceUnit(c.RemoteAddr())
+	}
+	if _, failed := server.parseFrom(buf, c.RemoteAddr(), source); failed > 0 {
+		server.stats.Record(server.name, "parse.errors", int64(failed))
+	}
+	return gnet.None
+}
+
+// onPacket hands a whole binary datagram to the parser, truncated ones are
+// dropped as there is no safe point to cut them.
+func (server *GosheniteServer) onPacket(c gnet.Conn) gnet.Action {
+	buf, _ := c.Next(-1)
+	server.stats.Record(server.name, "datagrams")
+	if !server.acl.allowed(c.RemoteAddr()) {
+		server.stats.Record(server.name, "rejected.acl")
+		return gnet.None
+	}
+
+	if len(buf) >= server.readBuffer {
+		server.stats.Record(server.name, "truncated")
+		return gnet.None
+	}
+	if _, failed := server.parse(buf, c.RemoteAddr()); failed > 0 {
+		server.stats.Record(server.name, "parse.errors", int64(failed))
+	}
+	return gnet.None
+}
+
+func (server *GosheniteServer) onPickleTraffic(c gnet.Conn, state *connState) gnet.Action {
+	origin := clientHost(state.client)
+	for c.InboundBuffered() >= 4 {
+		header, _ := c.Peek(4)
+		size := int(binary.BigEndian.Uint32(header))
+		if size > PickleMaxFrameSize {
+			server.stats.Record("parser.errors", "pickle_frame_too_big")
+			return gnet.Close
+		}
+		if c.InboundBuffered() < 4+size {
+			// wait for the rest of the frame
+			return gnet.None
+		}
+		frame, _ := c.Next(4 + size)
+
+		dps, err := ParsePickleGraphiteProtocol(frame[4:])
+		if err != nil {
+			server.stats.Record("parser.errors", err.Error())
+		}
+		for i := range dps {
+			dps[i].Origin = origin
+			server.bus.Emit(&dps[i])
+		}
+		if state.source != "" {
+			server.stats.Record(state.source, "accepted", int64(len(dps)))
+		}
+	}
+	return gnet.None
+}
+
+// OnTick closes connections quiet for longer than the idle timeout, it runs
+// only when the timeout is set
+func (server *GosheniteServer) OnTick() (time.Duration, gnet.Action) {
+	deadline := time.Now().Add(-server.idle).UnixNano()
+	server.conns.Range(func(c, state interface{}) bool {
+		if atomic.LoadInt64(&state.(*connState).active) < deadline {
+			server.conns.Delete(c)
+			server.stats.Record(server.name, "closed.idle")
+			c.(gnet.Conn).Close()
+		}
+		return true
+	})
+	if server.idle < 4*time.Second {
+		return time.Second, gnet.None
+	}
+	return server.idle / 4, gnet.None
+}
+
+func (server *GosheniteServer) Start() {
+	if server.network == "unix" {
+		if err := removeStaleSocket(server.socketPath); err != nil {
+			log.Fatal(err)
+		}
+		// the socket never has looser permissions than its mode, the umask is
+		// process wide and restored in OnBoot right after the bind
+		server.umask = syscall.Umask(0777 &^ int(server.socketMode))
+	}
+	err := gnet.Run(
+		server, server.addr,
+		gnet.WithMulticore(server.multicore),
+		gnet.WithReusePort(server.reuseport),
+		gnet.WithReadBufferCap(server.config.Buffer),
+		gnet.WithTicker(server.idle > 0),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func (server *GosheniteServer) Shutdown(ctx context.Context) {
-	log.Info("Shutting down server...")
+	log.Info("Shutting down server ", server.addr, "...")
 	server.eng.Stop(ctx)
 }
+
+func NewGosheniteServer(name string, protocol string, network string, config *ListenerConfig, endpoint *EndpointConfig, stats *Stats, bus *Bus) *GosheniteServer {
+	server := &GosheniteServer{
+		lineHandler: newLineHandler(name, config, stats, bus),
+		protocol:    protocol,
+		network:     network,
+		addr:        fmt.Sprintf("%s://:%d", network, config.Port),
+		multicore:   endpoint.Multicore,
+		reuseport:   endpoint.Reuseport,
+		readBuffer:  GnetReadBufferCap(config.Buffer),
+		config:      config,
+	}
+	server.parse = server.parsePlain
+	if config.Compression != "" && config.Compression != "none" {
+		if err := checkCompression(config.Compression); err != nil {
+			log.Fatal(err, " ", config.Compression, " for ", name, " listener")
+		}
+		if network == "udp" || protocol != "plain" {
+			log.Warn("Compression is not supported by the ", network, " ", name, " listener, ignored")
+		} else {
+			server.compressed = true
+			if config.Backlog < 1 {
+				config.Backlog = DefaultCompressedBacklog
+			}
+		}
+	}
+	acl, err := newAccessList(config.Allow, config.Deny)
+	if err != nil {
+		log.Fatal(err, " in the ", name, " listener access list")
+	}
+	server.acl = acl
+	if server.trusted, err = newAccessList(config.TrustedProxies, nil); err != nil {
+		log.Fatal(err, " in the ", name, " listener trusted proxies")
+	}
+	if config.IdleTimeout != "" && network != "udp" {
+		server.idle = ParseDurationWithFallback(config.IdleTimeout, 0)
+	}
+	if config.Proxy {
+		if network == "udp" {
+			log.Warn("PROXY protocol is not supported by the udp ", name, " listener, ignored")
+		} else {
+			server.proxy = true
+		}
+	}
+	return server
+}
+
+// NewLineServer is a line based listener speaking other than the graphite
+// plaintext protocol, lines are handed to parse.
+func NewLineServer(name string, network string, config *ListenerConfig, endpoint *EndpointConfig, parse LineParser, stats *Stats, bus *Bus) *GosheniteServer {
+	server := NewGosheniteServer(name, "plain", network, config, endpoint, stats, bus)
+	server.parse = parse
+	return server
+}
+
+// NewPacketServer is a UDP listener for binary protocols, every datagram is
+// handed to parse as a whole.
+func NewPacketServer(name string, config *ListenerConfig, endpoint *EndpointConfig, parse LineParser, stats *Stats, bus *Bus) *GosheniteServer {
+	server := NewGosheniteServer(name, "packet", "udp", config, endpoint, stats, bus)
+	server.parse = parse
+	return server
+}
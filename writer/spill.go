@@ -0,0 +1,555 @@
+// spill
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+const (
+	spillSegmentSize = 64 << 20
+	spillExtension   = ".spill"
+	spillPosition    = "position"
+	// record header, payload length and its crc32
+	spillHeaderLength = 8
+	// replayed datapoints between saves of the position
+	spillSaveEvery = 1024
+)
+
+var (
+	errSpillCorrupt = errors.New("corrupt spill record")
+	spillCRC        = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type spillSegment struct {
+	id       uint64
+	size     int64
+	modified time.Time
+}
+
+// spillLog is an append-only log of datapoints split into segment files,
+// workers append to it and a single replayer reads it back in order. The
+// replay position is saved next to the segments so the log survives a
+// restart, records read since the last save are replayed again.
+type spillLog struct {
+	sync.Mutex
+	config   *SpillConfig
+	maxAge   time.Duration
+	interval time.Duration
+	segments []*spillSegment // oldest first, the last one is appended to
+	file     *os.File        // the last segment
+	dirty    bool            // written since the last fsync
+	total    int64           // bytes in all segments
+
+	// the next record to replay
+	readID     uint64
+	readOffset int64
+
+	// owned by the replayer
+	reader       *bufio.Reader
+	readerFile   *os.File
+	readerID     uint64
+	readerOffset int64
+	peekedID     uint64
+	peekedNext   int64
+
+	spilling int32         // atomic, there is something to replay
+	notify   chan struct{} // wakes the replayer
+	stats    *Stats
+}
+
+func (l *spillLog) path(id uint64) string {
+	return filepath.Join(l.config.Dir, fmt.Sprintf("%020d%s", id, spillExtension))
+}
+
+// pending tells whether datapoints have to queue up behind the log
+func (l *spillLog) pending() bool {
+	return atomic.LoadInt32(&l.spilling) == 1
+}
+
+func (l *spillLog) append(datapoint *DataPoint) error {
+	record := encodeSpillRecord(datapoint)
+	size := int64(len(record))
+	l.Lock()
+	defer l.Unlock()
+	if active := l.segments[len(l.segments)-1]; l.file == nil || (active.size > 0 && active.size+size > l.config.SegmentSize) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.config.MaxSize > 0 {
+		l.trim(size)
+	}
+	active := l.segments[len(l.segments)-1]
+	n, err := l.file.Write(record)
+	active.size += int64(n)
+	active.modified = time.Now()
+	l.total += int64(n)
+	if err != nil {
+		// a torn record ends the segment for the replayer
+		l.rotate()
+		return err
+	}
+	if l.config.Fsync == FsyncAlways {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		l.dirty = true
+	}
+	atomic.StoreInt32(&l.spilling, 1)
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+	l.stats.Record("bus", "spill.written")
+	return nil
+}
+
+// rotate seals the last segment and starts a new one, with the lock held
+func (l *spillLog) rotate() error {
+	id := uint64(1)
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1].id + 1
+	}
+	if l.file != nil {
+		if l.config.Fsync != FsyncNever {
+			l.file.Sync()
+		}
+		l.file.Close()
+		l.dirty = false
+	}
+	file, err := os.OpenFile(l.path(id), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		l.file = nil
+		return err
+	}
+	l.file = file
+	l.segments = append(l.segments, &spillSegment{id: id, modified: time.Now()})
+	return nil
+}
+
+// trim drops the oldest segments to make room for size bytes, with the lock held
+func (l *spillLog) trim(size int64) {
+	for l.total+size > l.config.MaxSize {
+		if len(l.segments) == 1 {
+			if l.segments[0].size == 0 || l.rotate() != nil {
+				return
+			}
+		}
+		l.drop("size")
+	}
+}
+
+// expire drops segments not written for maxAge, with the lock held
+func (l *spillLog) expire() {
+	cutoff := time.Now().Add(-l.maxAge)
+	for l.segments[0].modified.Before(cutoff) {
+		if len(l.segments) == 1 {
+			if l.segments[0].size == 0 || l.rotate() != nil {
+				return
+			}
+		}
+		l.drop("age")
+	}
+}
+
+// drop removes the oldest segment whether it was replayed or not
+func (l *spillLog) drop(reason string) {
+	segment := l.segments[0]
+	unread := int64(0)
+	switch {
+	case segment.id > l.readID:
+		unread = segment.size
+	case segment.id == l.readID:
+		unread = segment.size - l.readOffset
+	}
+	l.remove(1)
+	if unread > 0 {
+		log.Warn("Spill log over its ", reason, " limit, dropped ", unread, " bytes")
+		l.stats.Record("bus", "spill.dropped."+reason)
+		l.stats.Record("bus", "spill.dropped_bytes", unread)
+	}
+}
+
+// remove deletes the n oldest segments, with the lock held
+func (l *spillLog) remove(n int) {
+	for _, segment := range l.segments[:n] {
+		if err := os.Remove(l.path(segment.id)); err != nil {
+			log.Error("Cannot remove spill segment: ", err)
+		}
+		l.total -= segment.size
+	}
+	l.segments = l.segments[n:]
+	if len(l.segments) > 0 && l.readID < l.segments[0].id {
+		l.readID, l.readOffset = l.segments[0].id, 0
+	}
+}
+
+// peek returns the next datapoint to replay, false when there is none. It
+// stays the next one until committed, segments replayed in full are removed.
+func (l *spillLog) peek() (*DataPoint, bool) {
+	for {
+		l.Lock()
+		i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].id >= l.readID })
+		if i == len(l.segments) {
+			i = len(l.segments) - 1
+		}
+		segment := l.segments[i]
+		if segment.id != l.readID {
+			l.readID, l.readOffset = segment.id, 0
+		}
+		if l.readOffset >= segment.size {
+			if i == len(l.segments)-1 {
+				atomic.StoreInt32(&l.spilling, 0)
+				l.Unlock()
+				return nil, false
+			}
+			l.remove(i + 1)
+			l.Unlock()
+			continue
+		}
+		id, offset, limit := segment.id, l.readOffset, segment.size
+		l.Unlock()
+
+		datapoint, next, err := l.read(id, offset, limit)
+		if err == nil {
+			l.peekedID, l.peekedNext = id, next
+			return datapoint, true
+		}
+		l.closeReader()
+		l.Lock()
+		// unless the segment was dropped meanwhile
+		if l.readID == id {
+			log.Warn("Skipping the rest of spill segment ", l.path(id), ": ", err)
+			l.stats.Record("bus", "spill.corrupt")
+			l.readOffset = limit
+		}
+		l.Unlock()
+	}
+}
+
+// commit moves past the datapoint returned by peek
+func (l *spillLog) commit() {
+	l.Lock()
+	if l.readID == l.peekedID {
+		l.readOffset = l.peekedNext
+	}
+	l.Unlock()
+}
+
+// read decodes the record at offset, limit is the end of the segment
+func (l *spillLog) read(id uint64, offset, limit int64) (*DataPoint, int64, error) {
+	if l.reader == nil || l.readerID != id || l.readerOffset != offset {
+		l.closeReader()
+		file, err := os.Open(l.path(id))
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		l.readerFile, l.reader = file, bufio.NewReaderSize(file, 64*1024)
+		l.readerID, l.readerOffset = id, offset
+	}
+	var header [spillHeaderLength]byte
+	if _, err := io.ReadFull(l.reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.LittleEndian.Uint32(header[:4]))
+	next := offset + spillHeaderLength + length
+	if next > limit {
+		return nil, 0, errSpillCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(l.reader, payload); err != nil {
+		return nil, 0, err
+	}
+	l.readerOffset = next
+	if crc32.Checksum(payload, spillCRC) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, errSpillCorrupt
+	}
+	datapoint, err := decodeSpillRecord(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return datapoint, next, nil
+}
+
+func (l *spillLog) closeReader() {
+	if l.readerFile != nil {
+		l.readerFile.Close()
+		l.readerFile, l.reader = nil, nil
+	}
+}
+
+// backlog is the number of bytes left to replay
+func (l *spillLog) backlog() (int64, int) {
+	l.Lock()
+	defer l.Unlock()
+	bytes := int64(0)
+	for _, segment := range l.segments {
+		switch {
+		case segment.id > l.readID:
+			bytes += segment.size
+		case segment.id == l.readID:
+			bytes += segment.size - l.readOffset
+		}
+	}
+	return bytes, len(l.segments)
+}
+
+// savePosition persists the replay position, replaced atomically
+func (l *spillLog) savePosition() {
+	l.Lock()
+	position := fmt.Sprintf("%d %d\n", l.readID, l.readOffset)
+	l.Unlock()
+	path := filepath.Join(l.config.Dir, spillPosition)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err == nil {
+		_, err = file.WriteString(position)
+		if err == nil && l.config.Fsync != FsyncNever {
+			err = file.Sync()
+		}
+		file.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Error("Cannot save spill position: ", err)
+		l.stats.Record("bus", "spill.errors")
+	}
+}
+
+// run fsyncs (interval policy), expires segments and reports the backlog
+func (l *spillLog) run(done chan struct{}) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Lock()
+			if l.dirty && l.file != nil {
+				l.file.Sync()
+				l.dirty = false
+			}
+			if l.maxAge > 0 {
+				l.expire()
+			}
+			l.Unlock()
+			backlog, segments := l.backlog()
+			l.stats.RecordFixed("bus", "spill.backlog", backlog)
+			l.stats.RecordFixed("bus", "spill.segments", int64(segments))
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close is called once nothing appends or replays anymore
+func (l *spillLog) Close() {
+	l.Lock()
+	if l.file != nil {
+		if l.config.Fsync != FsyncNever {
+			l.file.Sync()
+		}
+		l.file.Close()
+		l.file = nil
+	}
+	l.Unlock()
+	l.closeReader()
+	l.savePosition()
+}
+
+// load finds the segments and the replay position left by a previous run
+func (l *spillLog) load() error {
+	entries, err := os.ReadDir(l.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, spillExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spillExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, &spillSegment{id: id, size: info.Size(), modified: info.ModTime()})
+		l.total += info.Size()
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].id < l.segments[j].id })
+
+	position, err := os.ReadFile(filepath.Join(l.config.Dir, spillPosition))
+	if err == nil {
+		if _, err := fmt.Sscanf(string(position), "%d %d", &l.readID, &l.readOffset); err != nil {
+			log.Warn("Ignoring spill position: ", err)
+			l.readID, l.readOffset = 0, 0
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// segments replayed before the last save but not removed yet
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].id >= l.readID })
+	if i > 0 {
+		l.remove(i)
+	}
+	// appending always starts a new segment, a torn record at the end of
+	// the previous one is skipped on replay
+	return l.rotate()
+}
+
+func newSpillLog(config *SpillConfig, stats *Stats) (*spillLog, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = spillSegmentSize
+	}
+	if config.MaxSize > 0 && config.SegmentSize > config.MaxSize/4 {
+		// leave room for a few segments, only whole ones are dropped
+		config.SegmentSize = config.MaxSize / 4
+	}
+	switch config.Fsync {
+	case "":
+		config.Fsync = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		log.Warn("Unknown spill fsync policy ", config.Fsync, ", using ", FsyncInterval)
+		config.Fsync = FsyncInterval
+	}
+	l := &spillLog{
+		config:   config,
+		interval: time.Second,
+		notify:   make(chan struct{}, 1),
+		stats:    stats,
+	}
+	if config.Interval != "" {
+		l.interval = ParseDurationWithFallback(config.Interval, time.Second)
+	}
+	if config.MaxAge != "" {
+		l.maxAge = ParseDurationWithFallback(config.MaxAge, 0)
+	}
+	if err := os.MkdirAll(config.Dir, 0750); err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if backlog, segments := l.backlog(); backlog > 0 {
+		log.Info("Spill log has ", backlog, " bytes in ", segments, " segments to replay")
+		l.spilling = 1
+	}
+	return l, nil
+}
+
+// encodeSpillRecord frames a datapoint as length, crc32 and payload, tags
+// are counted from 1 so untagged series stay untagged
+func encodeSpillRecord(datapoint *DataPoint) []byte {
+	buf := make([]byte, spillHeaderLength, spillHeaderLength+32+len(datapoint.Metric)+len(datapoint.Origin))
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(datapoint.Value))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(datapoint.Timestamp))
+	buf = appendSpillString(buf, datapoint.Metric)
+	buf = appendSpillString(buf, datapoint.Origin)
+	if datapoint.Tags == nil {
+		buf = binary.AppendUvarint(buf, 0)
+	} else {
+		buf = binary.AppendUvarint(buf, uint64(len(datapoint.Tags))+1)
+		for k, v := range datapoint.Tags {
+			buf = appendSpillString(buf, k)
+			buf = appendSpillString(buf, v)
+		}
+	}
+	payload := buf[spillHeaderLength:]
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(payload, spillCRC))
+	return buf
+}
+
+func appendSpillString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func decodeSpillRecord(payload []byte) (*DataPoint, error) {
+	d := spillDecoder{buf: payload}
+	datapoint := &DataPoint{
+		Value:     math.Float64frombits(d.uint64()),
+		Timestamp: int64(d.uint64()),
+		Metric:    d.string(),
+		Origin:    d.string(),
+	}
+	if tags := d.uvarint(); tags > 0 && d.err == nil {
+		datapoint.Tags = make(map[string]string)
+		for i := uint64(1); i < tags && d.err == nil; i++ {
+			k := d.string()
+			datapoint.Tags[k] = d.string()
+		}
+	}
+	if d.err != nil || len(d.buf) > 0 {
+		return nil, errSpillCorrupt
+	}
+	return datapoint, nil
+}
+
+// spillDecoder reads a payload, the first error sticks
+type spillDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *spillDecoder) uint64() uint64 {
+	if len(d.buf) < 8 {
+		d.err = errSpillCorrupt
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *spillDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errSpillCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *spillDecoder) string() string {
+	n := d.uvarint()
+	if uint64(len(d.buf)) < n {
+		d.err = errSpillCorrupt
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
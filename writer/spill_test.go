@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSpillRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		datapoint DataPoint
+	}{
+		{"plain", DataPoint{Metric: "a.b.c", Value: 1.5, Timestamp: 1700000000}},
+		{"origin", DataPoint{Metric: "a.b", Value: -3, Timestamp: 1, Origin: "10.1.1.1"}},
+		{"no tags", DataPoint{Metric: "a", Value: 0, Timestamp: 0, Tags: map[string]string{}}},
+		{"tags", DataPoint{Metric: "cpu;dc=eu;host=a", Value: math.MaxFloat64, Timestamp: -1, Tags: map[string]string{"dc": "eu", "host": "a"}}},
+		{"empty", DataPoint{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := encodeSpillRecord(&test.datapoint)
+			datapoint, err := decodeSpillRecord(record[spillHeaderLength:])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(*datapoint, test.datapoint) {
+				t.Fatalf("got %+v, expected %+v", *datapoint, test.datapoint)
+			}
+		})
+	}
+}
+
+func TestSpillRecordDecodeErrors(t *testing.T) {
+	record := encodeSpillRecord(&DataPoint{Metric: "a.b", Value: 1, Timestamp: 1, Tags: map[string]string{"k": "v"}})
+	payload := record[spillHeaderLength:]
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"truncated value", payload[:4]},
+		{"truncated metric", payload[:17]},
+		{"truncated tags", payload[:len(payload)-1]},
+		{"trailing bytes", append(append([]byte(nil), payload...), 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeSpillRecord(test.payload); !errors.Is(err, errSpillCorrupt) {
+				t.Fatalf("got %v, expected %v", err, errSpillCorrupt)
+			}
+		})
+	}
+}
+
+func newTestSpillLog(t *testing.T, dir string) (*spillLog, *Stats) {
+	t.Helper()
+	stats := NewStats(&StatsConfig{}, "test")
+	l, err := newSpillLog(&SpillConfig{Dir: dir, Fsync: FsyncNever}, stats)
+	if err != nil {
+		t.Fatalf("cannot open spill log: %v", err)
+	}
+	return l, stats
+}
+
+func spillMetrics(t *testing.T, l *spillLog) []string {
+	t.Helper()
+	var metrics []string
+	for {
+		datapoint, ok := l.peek()
+		if !ok {
+			return metrics
+		}
+		metrics = append(metrics, datapoint.Metric)
+		l.commit()
+	}
+}
+
+func TestSpillLogCorruption(t *testing.T) {
+	tests := []struct {
+		name     string
+		corrupt  func(data []byte, record int) []byte // record is the length of one
+		expected []string
+		skipped  bool
+	}{
+		{"intact", func(data []byte, record int) []byte { return data }, []string{"m0", "m1", "m2", "m3"}, false},
+		{"crc", func(data []byte, record int) []byte {
+			data[record+spillHeaderLength+2] ^= 0xff
+			return data
+		}, []string{"m0", "m3"}, true},
+		{"torn tail", func(data []byte, record int) []byte { return data[:len(data)-3] }, []string{"m0", "m1", "m3"}, true},
+		{"bad length", func(data []byte, record int) []byte {
+			data[record] = 0xff
+			return data
+		}, []string{"m0", "m3"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, _ := newTestSpillLog(t, dir)
+			for i := 0; i < 3; i++ {
+				l.append(&DataPoint{Metric: fmt.Sprintf("m%d", i), Value: 1, Timestamp: 1})
+			}
+			l.Close()
+			path := l.path(l.segments[len(l.segments)-1].id)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.corrupt(data, len(data)/3), 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			// the rest of a damaged segment is skipped, later ones are replayed
+			l, stats := newTestSpillLog(t, dir)
+			defer l.Close()
+			l.append(&DataPoint{Metric: "m3", Value: 1, Timestamp: 1})
+			if metrics := spillMetrics(t, l); !reflect.DeepEqual(metrics, test.expected) {
+				t.Fatalf("got %v, expected %v", metrics, test.expected)
+			}
+			if corrupt := stats.metrics["bus.spill.corrupt"]; (corrupt > 0) != test.skipped {
+				t.Fatalf("got %d corrupt segments", corrupt)
+			}
+		})
+	}
+}
+
+func TestSpillLogReplayPosition(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed int // before the position is saved
+		more      int // committed after the save
+		expected  []string
+	}{
+		{"nothing replayed", 0, 0, []string{"m0", "m1", "m2", "m3", "m4"}},
+		{"partly replayed", 2, 0, []string{"m2", "m3", "m4"}},
+		{"replayed after the save", 2, 2, []string{"m2", "m3", "m4"}},
+		{"fully replayed", 5, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, _ := newTestSpillLog(t, dir)
+			for i := 0; i < 5; i++ {
+				l.append(&DataPoint{Metric: fmt.Sprintf("m%d", i), Value: 1, Timestamp: 1})
+			}
+			for i := 0; i < test.committed; i++ {
+				if _, ok := l.peek(); !ok {
+					t.Fatal("spill log is empty")
+				}
+				l.commit()
+			}
+			l.savePosition()
+			for i := 0; i < test.more; i++ {
+				l.peek()
+				l.commit()
+			}
+			// a crash, Close would save the position again
+			l.closeReader()
+			l.file.Close()
+
+			l, _ = newTestSpillLog(t, dir)
+			defer l.Close()
+			if pending := l.pending(); pending != (test.expected != nil) {
+				t.Fatalf("got pending %v", pending)
+			}
+			if metrics := spillMetrics(t, l); !reflect.DeepEqual(metrics, test.expected) {
+				t.Fatalf("got %v, expected %v", metrics, test.expected)
+			}
+		})
+	}
+}
@@ -35,14 +35,22 @@ func (s *Stats) Record(unit string, stat string, value ...int64) {
 
 func (s *Stats) Drain() {
 	ts := time.Now().Unix()
-	for len(s.metrics) > 0 && s.lastFlush-ts > 0 {
+	pending := func() bool {
+		s.RLock()
+		defer s.RUnlock()
+		return len(s.metrics) > 0 && s.lastFlush-ts > 0
+	}
+	for pending() {
 		time.Sleep(1 * time.Minute)
 	}
 }
 
 func (s *Stats) RecordMetricIngestion(metric string) {
 	if s.config.Segment > 0 {
-		segment := strings.Split(metric, ".")[0]
+		segment := metric
+		if i := strings.IndexAny(metric, ".;"); i >= 0 {
+			segment = metric[:i]
+		}
 		s.Record("metric", segment)
 	}
 }
@@ -77,7 +85,9 @@ func (s *Stats) Flush() {
 
 		}
 	}
+	s.Lock()
 	s.lastFlush = time.Now().Unix()
+	s.Unlock()
 }
 
 func NewStats(config *StatsConfig, hostname string) *Stats {
@@ -0,0 +1,357 @@
+// statsd
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errBadMetricType = errors.New("bad_metric_type")
+
+var statsdNameReplacer = strings.NewReplacer(" ", "_", "/", "-")
+
+// statsdName follows the statsd key sanitization, whitespace becomes `_`,
+// slash `-` and anything outside [a-zA-Z0-9_.-] is removed.
+func statsdName(name string) string {
+	name = statsdNameReplacer.Replace(name)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return -1
+	}, name)
+}
+
+type statsdTimer struct {
+	values []float64
+	count  float64 // sampling corrected
+}
+
+// statsdBuckets holds everything aggregated within a single flush interval
+type statsdBuckets struct {
+	counters map[string]float64
+	timers   map[string]*statsdTimer
+	sets     map[string]map[string]struct{}
+}
+
+func newStatsdBuckets() statsdBuckets {
+	return statsdBuckets{
+		counters: make(map[string]float64),
+		timers:   make(map[string]*statsdTimer),
+		sets:     make(map[string]map[string]struct{}),
+	}
+}
+
+// StatsdServer aggregates statsd counters, timers, gauges and sets received
+// over UDP and/or TCP and emits the results every flush interval. DogStatsD
+// tags are part of the aggregation key.
+type StatsdServer struct {
+	sync.Mutex
+	lineHandler
+
+	config    *StatsdConfig
+	interval  time.Duration
+	buckets   statsdBuckets
+	gauges    map[string]float64 // gauges keep their last value between flushes
+	listeners []*GosheniteServer
+	done      chan struct{}
+}
+
+// seriesKey is the aggregation key, the name with dogstatsd tags either as
+// canonical graphite tags or with tag values appended
+func (s *StatsdServer) seriesKey(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	if s.config.Tagged {
+		return CanonicalSeriesName(name, TagsFromLabels(tags))
+	}
+	return AppendTagValues(name, tags, nil)
+}
+
+// statsdMetric puts prefix and suffix around the name part of a series key
+func statsdMetric(prefix, key, suffix string) string {
+	name, tags := key, ""
+	if i := strings.IndexByte(key, ';'); i >= 0 {
+		name, tags = key[:i], key[i:]
+	}
+	return prefix + "." + name + suffix + tags
+}
+
+// ParseDatadogTags turns `key:value` tags into a map, tags without a value
+// are set to true
+func ParseDatadogTags(tags []string) map[string]string {
+	result := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		k, v, ok := strings.Cut(tag, ":")
+		if k == "" {
+			continue
+		}
+		if !ok || v == "" {
+			v = "true"
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// parseLine handles `name:value|type[|@rate][|#tag:value,...]`, dogstatsd
+// events and service checks are ignored
+func (s *StatsdServer) parseLine(line []byte) error {
+	if bytes.HasPrefix(line, []byte("_e{")) || bytes.HasPrefix(line, []byte("_sc|")) {
+		s.stats.Record(s.name, "ignored")
+		return nil
+	}
+	colon := bytes.IndexByte(line, ':')
+	if colon < 1 {
+		return errBadMessage
+	}
+	name := statsdName(string(line[:colon]))
+	if name == "" {
+		return errBadMessage
+	}
+	fields := strings.Split(string(line[colon+1:]), "|")
+	if len(fields) < 2 || fields[0] == "" {
+		return errBadMessage
+	}
+	raw, typ := fields[0], fields[1]
+	rate := 1.0
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return errBadValue
+			}
+			rate = r
+		case strings.HasPrefix(field, "#"):
+			name = s.seriesKey(name, ParseDatadogTags(strings.Split(field[1:], ",")))
+		}
+	}
+
+	if typ == "s" {
+		s.Lock()
+		set, ok := s.buckets.sets[name]
+		if !ok {
+			set = make(map[string]struct{})
+			s.buckets.sets[name] = set
+		}
+		set[raw] = struct{}{}
+		s.Unlock()
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return errBadValue
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	switch typ {
+	case "c":
+		s.buckets.counters[name] += value / rate
+	case "ms", "h", "d":
+		timer, ok := s.buckets.timers[name]
+		if !ok {
+			timer = &statsdTimer{}
+			s.buckets.timers[name] = timer
+		}
+		timer.values = append(timer.values, value)
+		timer.count += 1 / rate
+	case "g":
+		// explicitly signed values modify the current gauge
+		if raw[0] == '+' || raw[0] == '-' {
+			s.gauges[name] += value
+		} else {
+			s.gauges[name] = value
+		}
+	default:
+		return errBadMetricType
+	}
+	return nil
+}
+
+func (s *StatsdServer) parseLines(buf []byte, client net.Addr) (int, int) {
+	accepted, rejected := 0, 0
+	for len(buf) > 0 {
+		var line []byte
+		if end := bytes.IndexByte(buf, '\n'); end >= 0 {
+			line, buf = buf[:end], buf[end+1:]
+		} else {
+			line, buf = buf, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if err := s.parseLine(line); err != nil {
+			rejected++
+			s.stats.Record("parser.errors", err.Error())
+			s.sampleParseError(line, err, client)
+			continue
+		}
+		accepted++
+	}
+	s.stats.Record(s.name, "metrics", int64(accepted))
+	return accepted, rejected
+}
+
+func percentileSuffix(pct float64) string {
+	return strings.ReplaceAll(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_")
+}
+
+// Flush emits aggregates of the past interval and resets counters, timers
+// and sets.
+func (s *StatsdServer) Flush() {
+	s.Lock()
+	buckets := s.buckets
+	s.buckets = newStatsdBuckets()
+	gauges := make(map[string]float64, len(s.gauges))
+	for name, value := range s.gauges {
+		gauges[name] = value
+	}
+	s.Unlock()
+
+	ts := time.Now().Unix()
+	seconds := s.interval.Seconds()
+	prefix := s.config.Prefix
+	emitted := 0
+	emit := func(metric string, value float64) {
+		dp, err := NewDataPoint(metric, value, ts)
+		if err != nil {
+			s.stats.Record("parser.errors", err.Error())
+			return
+		}
+		s.bus.Emit(&dp)
+		emitted++
+	}
+
+	for name, count := range buckets.counters {
+		emit(statsdMetric(prefix.Counter, name, ".count"), count)
+		emit(statsdMetric(prefix.Counter, name, ".rate"), count/seconds)
+	}
+	for name, timer := range buckets.timers {
+		values := timer.values
+		sort.Float64s(values)
+		n := len(values)
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		mean := sum / float64(n)
+		variance := 0.0
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+		median := values[n/2]
+		if n%2 == 0 {
+			median = (values[n/2-1] + values[n/2]) / 2
+		}
+
+		emit(statsdMetric(prefix.Timer, name, ".count"), timer.count)
+		emit(statsdMetric(prefix.Timer, name, ".count_ps"), timer.count/seconds)
+		emit(statsdMetric(prefix.Timer, name, ".lower"), values[0])
+		emit(statsdMetric(prefix.Timer, name, ".upper"), values[n-1])
+		emit(statsdMetric(prefix.Timer, name, ".sum"), sum)
+		emit(statsdMetric(prefix.Timer, name, ".mean"), mean)
+		emit(statsdMetric(prefix.Timer, name, ".median"), median)
+		emit(statsdMetric(prefix.Timer, name, ".std"), math.Sqrt(variance/float64(n)))
+		for _, pct := range s.config.Percentiles {
+			within := int(math.Round(pct / 100 * float64(n)))
+			if within < 1 {
+				continue
+			}
+			pctSum := 0.0
+			for _, v := range values[:within] {
+				pctSum += v
+			}
+			suffix := percentileSuffix(pct)
+			emit(statsdMetric(prefix.Timer, name, ".upper_"+suffix), values[within-1])
+			emit(statsdMetric(prefix.Timer, name, ".sum_"+suffix), pctSum)
+			emit(statsdMetric(prefix.Timer, name, ".mean_"+suffix), pctSum/float64(within))
+		}
+	}
+	for name, value := range gauges {
+		emit(statsdMetric(prefix.Gauge, name, ""), value)
+	}
+	for name, set := range buckets.sets {
+		emit(statsdMetric(prefix.Set, name, ".count"), float64(len(set)))
+	}
+	s.stats.Record(s.name, "flushed", int64(emitted))
+}
+
+func (s *StatsdServer) Start() {
+	for _, listener := range s.listeners {
+		go listener.Start()
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Shutdown stops the listeners and flushes what was aggregated so far
+func (s *StatsdServer) Shutdown(ctx context.Context) {
+	for _, listener := range s.listeners {
+		listener.Shutdown(ctx)
+	}
+	close(s.done)
+	s.Flush()
+}
+
+func NewStatsdServer(config *StatsdConfig, endpoint *EndpointConfig, stats *Stats, bus *Bus) *StatsdServer {
+	if len(config.Percentiles) == 0 {
+		config.Percentiles = []float64{90}
+	}
+	if config.Prefix.Counter == "" {
+		config.Prefix.Counter = "stats.counters"
+	}
+	if config.Prefix.Timer == "" {
+		config.Prefix.Timer = "stats.timers"
+	}
+	if config.Prefix.Gauge == "" {
+		config.Prefix.Gauge = "stats.gauges"
+	}
+	if config.Prefix.Set == "" {
+		config.Prefix.Set = "stats.sets"
+	}
+	s := &StatsdServer{
+		lineHandler: newLineHandler("statsd", &config.ListenerConfig, stats, bus),
+		config:      config,
+		interval:    ParseDurationWithFallback(config.Flush, 10*time.Second),
+		buckets:     newStatsdBuckets(),
+		gauges:      make(map[string]float64),
+		done:        make(chan struct{}),
+	}
+	switch config.Network {
+	case "udp", "tcp":
+		s.listeners = append(s.listeners, NewLineServer("statsd", config.Network, &config.ListenerConfig, endpoint, s.parseLines, stats, bus))
+	default:
+		if config.Network != "" && config.Network != "both" {
+			log.Warn("Unknown statsd network ", config.Network, ", listening on both udp and tcp")
+		}
+		s.listeners = append(s.listeners,
+			NewLineServer("statsd", "udp", &config.ListenerConfig, endpoint, s.parseLines, stats, bus),
+			NewLineServer("statsd", "tcp", &config.ListenerConfig, endpoint, s.parseLines, stats, bus),
+		)
+	}
+	return s
+}
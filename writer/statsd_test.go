@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordStore keeps the value of every metric the bus writes
+type recordStore struct {
+	DevNull
+	sync.Mutex
+	values map[string]float64
+}
+
+func (s *recordStore) Insert(datapoint *DataPoint) error {
+	s.Lock()
+	defer s.Unlock()
+	s.values[datapoint.Metric] = datapoint.Value
+	return nil
+}
+
+// newRecordBus returns a started bus writing to a recordStore, draining it
+// returns what was written
+func newRecordBus() (*Bus, func() map[string]float64) {
+	store := &recordStore{values: make(map[string]float64)}
+	bus := NewBus(store, &DevNull{}, NewStats(&StatsConfig{}, "test"), &BusConfig{})
+	bus.Start()
+	return bus, func() map[string]float64 {
+		bus.Drain(context.Background())
+		return store.values
+	}
+}
+
+func statsdFlush(t *testing.T, config *StatsdConfig, lines string) map[string]float64 {
+	t.Helper()
+	bus, drain := newRecordBus()
+	config.Flush = "10s"
+	s := NewStatsdServer(config, &EndpointConfig{}, NewStats(&StatsConfig{}, "test"), bus)
+	if _, rejected := s.parseLines([]byte(lines), nil); rejected > 0 {
+		t.Fatalf("%d lines rejected", rejected)
+	}
+	s.Flush()
+	return drain()
+}
+
+func TestStatsdSampling(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    string
+		expected map[string]float64
+	}{
+		{"counter", "hits:1|c\nhits:2|c", map[string]float64{
+			"stats.counters.hits.count": 3, "stats.counters.hits.rate": 0.3}},
+		{"sampled counter", "hits:1|c|@0.1\nhits:1|c|@0.5", map[string]float64{
+			"stats.counters.hits.count": 12, "stats.counters.hits.rate": 1.2}},
+		{"sampled timer", "rt:10|ms|@0.5\nrt:20|ms|@0.25", map[string]float64{
+			"stats.timers.rt.count": 6, "stats.timers.rt.count_ps": 0.6, "stats.timers.rt.sum": 30}},
+		{"gauge is not sampled", "temp:5|g|@0.5\ntemp:+2|g\ntemp:-1|g", map[string]float64{
+			"stats.gauges.temp": 6}},
+		{"set", "users:a|s\nusers:b|s|@0.5\nusers:a|s", map[string]float64{
+			"stats.sets.users.count": 2}},
+		{"tags", "hits:1|c|@0.5|#env:prod", map[string]float64{
+			"stats.counters.hits.prod.count": 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := statsdFlush(t, &StatsdConfig{}, test.lines)
+			for metric, expected := range test.expected {
+				value, ok := values[metric]
+				if !ok || math.Abs(value-expected) > 1e-9 {
+					t.Errorf("%s: got %v, expected %v", metric, value, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsdPercentiles(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 10; i++ {
+		lines = append(lines, fmt.Sprintf("rt:%d|ms", 10+i))
+	}
+	tests := []struct {
+		name        string
+		percentiles []float64
+		expected    map[string]float64
+		missing     []string
+	}{
+		{"default", nil, map[string]float64{
+			"stats.timers.rt.upper_90": 19, "stats.timers.rt.sum_90": 135, "stats.timers.rt.mean_90": 15}, nil},
+		{"fractional", []float64{50, 99.9}, map[string]float64{
+			"stats.timers.rt.upper_50": 15, "stats.timers.rt.sum_50": 65, "stats.timers.rt.mean_50": 13,
+			"stats.timers.rt.upper_99_9": 20, "stats.timers.rt.sum_99_9": 155, "stats.timers.rt.mean_99_9": 15.5}, nil},
+		{"below one value", []float64{1}, nil, []string{
+			"stats.timers.rt.upper_1", "stats.timers.rt.sum_1", "stats.timers.rt.mean_1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := statsdFlush(t, &StatsdConfig{Percentiles: test.percentiles}, strings.Join(lines, "\n"))
+			for metric, expected := range test.expected {
+				value, ok := values[metric]
+				if !ok || math.Abs(value-expected) > 1e-9 {
+					t.Errorf("%s: got %v, expected %v", metric, value, expected)
+				}
+			}
+			for _, metric := range test.missing {
+				if _, ok := values[metric]; ok {
+					t.Errorf("unexpected %s", metric)
+				}
+			}
+			if values["stats.timers.rt.median"] != 15.5 || values["stats.timers.rt.lower"] != 11 || values["stats.timers.rt.upper"] != 20 {
+				t.Errorf("got median %v, lower %v, upper %v", values["stats.timers.rt.median"], values["stats.timers.rt.lower"], values["stats.timers.rt.upper"])
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,6 +13,15 @@ import (
 
 type IStore interface {
 	Insert(*DataPoint) error
+	Shutdown(ctx context.Context)
+}
+
+// IBatchStore writes bundles of datapoints in the background, Insert only
+// fails when the datapoint cannot be bundled
+type IBatchStore interface {
+	IStore
+	InsertNow(*DataPoint) error                   // bypasses the bundles
+	OnFailure(handler func(datapoint *DataPoint)) // datapoints of failed bundles
 }
 
 type CassandraStore struct {
@@ -20,9 +31,23 @@ type CassandraStore struct {
 	retentionInSeconds  int64
 	query               string
 	stats               *Stats
+	bundler             *Bundler // nil when writes are not bundled
+	concurrency         int
+	onFailure           func(datapoint *DataPoint)
 }
 
 func (s *CassandraStore) Insert(datapoint *DataPoint) error {
+	if s.bundler == nil {
+		return s.InsertNow(datapoint)
+	}
+	if datapoint.Timestamp < 1 {
+		datapoint.Timestamp = time.Now().Unix()
+	}
+	// waits while the bundles are over the buffer limit
+	return s.bundler.AddWait(context.Background(), datapoint, len(datapoint.Metric)+16)
+}
+
+func (s *CassandraStore) InsertNow(datapoint *DataPoint) error {
 	if datapoint.Timestamp < 1 {
 		datapoint.Timestamp = time.Now().Unix()
 	}
@@ -37,6 +62,100 @@ func (s *CassandraStore) Insert(datapoint *DataPoint) error {
 	return nil
 }
 
+func (s *CassandraStore) OnFailure(handler func(datapoint *DataPoint)) {
+	s.onFailure = handler
+}
+
+// writeBundle groups a bundle by partition (path), every partition is
+// written with a single unlogged batch, up to concurrency at once
+func (s *CassandraStore) writeBundle(items interface{}) {
+	start := time.Now()
+	datapoints := items.([]*DataPoint)
+	var paths []string
+	partitions := make(map[string][]*DataPoint)
+	for _, datapoint := range datapoints {
+		if _, ok := partitions[datapoint.Metric]; !ok {
+			paths = append(paths, datapoint.Metric)
+		}
+		partitions[datapoint.Metric] = append(partitions[datapoint.Metric], datapoint)
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.concurrency)
+	for _, path := range paths {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(partition []*DataPoint) {
+			defer wg.Done()
+			s.writePartition(partition)
+			<-slots
+		}(partitions[path])
+	}
+	wg.Wait()
+	s.stats.Record("cassandra", "store.bundles")
+	s.stats.Record("cassandra", "store.bundle_us", time.Since(start).Microseconds())
+}
+
+func (s *CassandraStore) writePartition(partition []*DataPoint) {
+	// statements of a batch share the write timestamp, so only the last
+	// datapoint of a cell is kept for it to win as it would unbundled
+	cells := make(map[int64]int, len(partition))
+	var latest []*DataPoint
+	for _, datapoint := range partition {
+		resTs := (datapoint.Timestamp / s.resolutionInSeconds) * s.resolutionInSeconds
+		if i, ok := cells[resTs]; ok {
+			latest[i] = datapoint
+			continue
+		}
+		cells[resTs] = len(latest)
+		latest = append(latest, datapoint)
+	}
+
+	var err error
+	if len(latest) == 1 {
+		datapoint := latest[0]
+		resTs := (datapoint.Timestamp / s.resolutionInSeconds) * s.resolutionInSeconds
+		err = s.session.Query(s.query, datapoint.Value, datapoint.Metric, resTs).Exec()
+	} else {
+		batch := s.session.NewBatch(gocql.UnloggedBatch)
+		for _, datapoint := range latest {
+			resTs := (datapoint.Timestamp / s.resolutionInSeconds) * s.resolutionInSeconds
+			batch.Query(s.query, datapoint.Value, datapoint.Metric, resTs)
+		}
+		err = s.session.ExecuteBatch(batch)
+		s.stats.Record("cassandra", "store.batches")
+	}
+	if err != nil {
+		log.Error("Failed inserting data into Cassandra:", err)
+		s.stats.Record("cassandra", "store.failed", int64(len(partition)))
+		if s.onFailure != nil {
+			for _, datapoint := range partition {
+				s.onFailure(datapoint)
+			}
+		}
+		return
+	}
+	s.stats.Record("cassandra", "store.success", int64(len(partition)))
+}
+
+// Shutdown writes what is still bundled
+func (s *CassandraStore) Shutdown(ctx context.Context) {
+	if s.bundler == nil {
+		return
+	}
+	log.Info("Flushing store bundles...")
+	flushed := make(chan struct{})
+	go func() {
+		s.bundler.Flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		log.Warn("Store bundles not flushed: ", ctx.Err())
+	}
+}
+
 func (s *CassandraStore) connect() error {
 	var err error
 	s.session, err = s.cluster.CreateSession()
@@ -69,6 +188,26 @@ func NewCassandraStore(config *StoreConfig, stats *Stats) (IStore, error) {
 		resolutionInSeconds: int64(res),
 		stats:               stats,
 	}
+	if config.Batch.Count > 0 {
+		store.bundler = NewBundler(&DataPoint{}, store.writeBundle)
+		store.bundler.BundleCountThreshold = config.Batch.Count
+		if config.Batch.Bytes > 0 {
+			store.bundler.BundleByteThreshold = config.Batch.Bytes
+		}
+		if config.Batch.Delay != "" {
+			store.bundler.DelayThreshold = ParseDurationWithFallback(config.Batch.Delay, DefaultDelayThreshold)
+		}
+		if config.Batch.Handlers > 0 {
+			store.bundler.HandlerLimit = config.Batch.Handlers
+		}
+		if config.Batch.Buffer > 0 {
+			store.bundler.BufferedByteLimit = config.Batch.Buffer
+		}
+		store.concurrency = config.Batch.Concurrency
+		if store.concurrency < 1 {
+			store.concurrency = 16
+		}
+	}
 
 	err := store.connect()
 	return store, err
@@ -0,0 +1,83 @@
+// tags
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var errBadTags = errors.New("bad_tags")
+
+// ParseTaggedMetric splits graphite 1.1 series `name;tag1=value1;tag2=value2`
+// into the name and tags, untagged metrics give nil tags.
+func ParseTaggedMetric(metric string) (string, map[string]string, error) {
+	i := strings.IndexByte(metric, ';')
+	if i < 0 {
+		return metric, nil, nil
+	}
+	name := metric[:i]
+	if name == "" {
+		return "", nil, errBadTags
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(metric[i+1:], ";") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || !validTagName(k) || !validTagValue(v) {
+			return "", nil, errBadTags
+		}
+		tags[k] = v
+	}
+	return name, tags, nil
+}
+
+func validTagName(k string) bool {
+	return k != "" && !strings.ContainsAny(k, ";!^=")
+}
+
+func validTagValue(v string) bool {
+	return v != "" && v[0] != '~' && !strings.ContainsRune(v, ';')
+}
+
+// SortedTagKeys returns tag names in the canonical (alphabetical) order
+func SortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CanonicalSeriesName builds `name;a=1;b=2` with tags sorted by name, so the
+// same series always ends up in the same store row and index document.
+func CanonicalSeriesName(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, k := range SortedTagKeys(tags) {
+		sb.WriteByte(';')
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(tags[k])
+	}
+	return sb.String()
+}
+
+// NewDataPoint parses the optional tags out of metric and canonicalizes it
+func NewDataPoint(metric string, value float64, timestamp int64) (DataPoint, error) {
+	name, tags, err := ParseTaggedMetric(metric)
+	if err != nil {
+		return DataPoint{}, err
+	}
+	return NewTaggedDataPoint(name, tags, value, timestamp), nil
+}
+
+func NewTaggedDataPoint(name string, tags map[string]string, value float64, timestamp int64) DataPoint {
+	if len(tags) == 0 {
+		tags = nil
+	}
+	return DataPoint{Metric: CanonicalSeriesName(name, tags), Value: value, Timestamp: timestamp, Tags: tags}
+}
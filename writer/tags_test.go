@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewDataPointCanonicalOrdering(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		series string
+		tags   map[string]string
+	}{
+		{"untagged", "a.b.c", "a.b.c", nil},
+		{"sorted", "cpu;dc=eu;host=a", "cpu;dc=eu;host=a", map[string]string{"dc": "eu", "host": "a"}},
+		{"unsorted", "cpu;host=a;dc=eu", "cpu;dc=eu;host=a", map[string]string{"dc": "eu", "host": "a"}},
+		{"byte order", "cpu;b=1;B=2;a=3;_=4", "cpu;B=2;_=4;a=3;b=1", map[string]string{"a": "3", "b": "1", "B": "2", "_": "4"}},
+		{"prefix keys", "cpu;ab=1;a=2", "cpu;a=2;ab=1", map[string]string{"a": "2", "ab": "1"}},
+		{"duplicate key, last wins", "cpu;a=1;a=2", "cpu;a=2", map[string]string{"a": "2"}},
+		{"value with equals", "cpu;q=a=b", "cpu;q=a=b", map[string]string{"q": "a=b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dp, err := NewDataPoint(test.metric, 1, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dp.Metric != test.series {
+				t.Errorf("got %q, expected %q", dp.Metric, test.series)
+			}
+			if !reflect.DeepEqual(dp.Tags, test.tags) {
+				t.Errorf("got tags %v, expected %v", dp.Tags, test.tags)
+			}
+		})
+	}
+}
+
+func TestParseTaggedMetricErrors(t *testing.T) {
+	for _, metric := range []string{
+		";a=1",
+		"cpu;",
+		"cpu;a",
+		"cpu;=1",
+		"cpu;a=",
+		"cpu;a=~1",
+		"cpu;a!=1",
+		"cpu;a^=1",
+	} {
+		t.Run(metric, func(t *testing.T) {
+			if _, _, err := ParseTaggedMetric(metric); !errors.Is(err, errBadTags) {
+				t.Fatalf("got %v, expected %v", err, errBadTags)
+			}
+		})
+	}
+}
+
+func TestCanonicalSeriesName(t *testing.T) {
+	// map iteration order is random, the name must not depend on it
+	tags := map[string]string{"z": "1", "m": "2", "a": "3"}
+	for i := 0; i < 10; i++ {
+		if name := CanonicalSeriesName("x", tags); name != "x;a=3;m=2;z=1" {
+			t.Fatalf("got %q", name)
+		}
+	}
+	if name := CanonicalSeriesName("x", map[string]string{}); name != "x" {
+		t.Fatalf("got %q for empty tags", name)
+	}
+}
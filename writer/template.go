@@ -0,0 +1,128 @@
+// template
+package main
+
+import (
+	"strings"
+)
+
+// segmentReplacer escapes characters that would break a graphite path segment
+// or a tag value.
+var segmentReplacer = strings.NewReplacer(".", "_", " ", "_", ";", "_", "=", "_", "\t", "_", "\n", "_", "\r", "_")
+
+func SanitizeSegment(s string) string {
+	return segmentReplacer.Replace(s)
+}
+
+// PathTemplate renders a dotted graphite path from labels, segments like
+// `{host}` are substituted with sanitized label values, literal segments are
+// kept as-is and segments of missing labels are skipped. Values of verbatim
+// labels (e.g. an already dotted metric name) are not sanitized.
+type PathTemplate struct {
+	segments []string
+	verbatim map[string]bool
+}
+
+func (t *PathTemplate) Render(labels map[string]string) string {
+	parts := make([]string, 0, len(t.segments))
+	for _, segment := range t.segments {
+		if len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}' {
+			key := segment[1 : len(segment)-1]
+			value, ok := labels[key]
+			if !ok || value == "" {
+				continue
+			}
+			if !t.verbatim[key] {
+				value = SanitizeSegment(value)
+			}
+			parts = append(parts, value)
+			continue
+		}
+		parts = append(parts, segment)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Labels returns label names referenced by the template
+func (t *PathTemplate) Labels() []string {
+	var labels []string
+	for _, segment := range t.segments {
+		if len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}' {
+			labels = append(labels, segment[1:len(segment)-1])
+		}
+	}
+	return labels
+}
+
+// NewPathTemplate splits the template on dots outside of placeholders, so
+// attribute names like {service.name} can be referenced.
+func NewPathTemplate(template string, verbatim ...string) *PathTemplate {
+	t := &PathTemplate{verbatim: make(map[string]bool)}
+	for _, key := range verbatim {
+		t.verbatim[key] = true
+	}
+	start, inPlaceholder := 0, false
+	for i := 0; i <= len(template); i++ {
+		if i < len(template) {
+			switch template[i] {
+			case '{':
+				inPlaceholder = true
+				continue
+			case '}':
+				inPlaceholder = false
+				continue
+			case '.':
+				if inPlaceholder {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if segment := template[start:i]; segment != "" {
+			t.segments = append(t.segments, segment)
+		}
+		start = i + 1
+	}
+	return t
+}
+
+// TagsFromLabels turns labels into graphite tags, skipping excluded names
+// and values graphite would reject.
+func TagsFromLabels(labels map[string]string, exclude ...string) map[string]string {
+	tags := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if v == "" || !validTagName(k) {
+			continue
+		}
+		excluded := false
+		for _, e := range exclude {
+			if k == e {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			continue
+		}
+		v = strings.ReplaceAll(v, ";", "_")
+		if v[0] == '~' {
+			v = "_" + v[1:]
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// AppendTagValues appends values of keys as path segments, all tags sorted
+// by key when keys is empty, for receivers flattening tags into the path.
+func AppendTagValues(path string, tags map[string]string, keys []string) string {
+	if len(keys) == 0 {
+		keys = SortedTagKeys(tags)
+	}
+	for _, k := range keys {
+		if v := tags[k]; v != "" {
+			path += "." + SanitizeSegment(v)
+		}
+	}
+	return path
+}
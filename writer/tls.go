@@ -0,0 +1,232 @@
+// tls
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader keeps the server tls.Config in sync with cert, key and CA
+// files on disk, so rotated certificates are picked up without a restart.
+type certReloader struct {
+	sync.Mutex
+	config    *TLSListenerConfig
+	interval  time.Duration
+	checked   time.Time
+	modTime   time.Time
+	tlsConfig *tls.Config
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.config.Cert, r.config.Key, r.config.Ca} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.config.Cert, r.config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.config.Ca != "" {
+		pem, err := os.ReadFile(r.config.Ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + r.config.Ca)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// GetConfigForClient is called on every handshake, files are checked at most
+// once per interval and a broken rotation keeps serving the previous config.
+func (r *certReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.checked) < r.interval {
+		return r.tlsConfig, nil
+	}
+	r.checked = time.Now()
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Error("Cannot stat certificates: ", err)
+		return r.tlsConfig, nil
+	}
+	if !modTime.After(r.modTime) {
+		return r.tlsConfig, nil
+	}
+	tlsConfig, err := r.load()
+	if err != nil {
+		log.Error("Cannot reload certificates: ", err)
+		return r.tlsConfig, nil
+	}
+	log.Info("Certificates reloaded: ", r.config.Cert)
+	r.tlsConfig, r.modTime = tlsConfig, modTime
+	return r.tlsConfig, nil
+}
+
+func newCertReloader(config *TLSListenerConfig) (*certReloader, error) {
+	r := &certReloader{
+		config:   config,
+		interval: ParseDurationWithFallback(config.Reload, time.Minute),
+		checked:  time.Now(),
+	}
+	var err error
+	if r.modTime, err = r.latestModTime(); err != nil {
+		return nil, err
+	}
+	if r.tlsConfig, err = r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSServer accepts the plaintext protocol over TLS, gnet has no TLS support
+// so it runs on the standard library with a goroutine per connection.
+type TLSServer struct {
+	lineHandler
+
+	addr     string
+	config   *TLSListenerConfig
+	reloader *certReloader
+	listener net.Listener
+	acl      *accessList
+	idle     time.Duration
+	conns    sync.Map
+	wg       sync.WaitGroup
+}
+
+func (server *TLSServer) handle(conn *tls.Conn) {
+	defer server.wg.Done()
+	defer server.conns.Delete(conn)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		server.stats.Record(server.name, "handshake.errors")
+		log.Debug("TLS handshake failed: ", conn.RemoteAddr(), " ", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	server.stats.Record(server.name, "connections")
+
+	if server.idle == 0 {
+		server.readStream(conn, &server.config.ListenerConfig, server.parsePlain, conn.RemoteAddr())
+		return
+	}
+	reader := &idleReader{conn: conn, timeout: server.idle}
+	server.readStream(reader, &server.config.ListenerConfig, server.parsePlain, conn.RemoteAddr())
+	if reader.expired {
+		server.stats.Record(server.name, "closed.idle")
+	}
+}
+
+// idleReader ends a stream quiet for longer than timeout
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	expired bool
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	n, err := r.conn.Read(p)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		r.expired = true
+	}
+	return n, err
+}
+
+func (server *TLSServer) Start() {
+	listener, err := net.Listen("tcp", server.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// clients are checked before the handshake
+	listener = newGuardedListener(listener, server.name, server.acl, server.config.MaxConnections, server.stats)
+	listener = tls.NewListener(listener, &tls.Config{GetConfigForClient: server.reloader.GetConfigForClient})
+	server.listener = listener
+	log.Info("Server started: listening on tls://", server.addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error("TLS accept failed: ", err)
+			continue
+		}
+		server.wg.Add(1)
+		server.conns.Store(conn, struct{}{})
+		go server.handle(conn.(*tls.Conn))
+	}
+}
+
+func (server *TLSServer) Shutdown(ctx context.Context) {
+	log.Info("Shutting down server tls://", server.addr, "...")
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	server.conns.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+	server.wg.Wait()
+}
+
+func NewTLSServer(config *TLSListenerConfig, stats *Stats, bus *Bus) (*TLSServer, error) {
+	if err := checkCompression(config.Compression); err != nil {
+		return nil, fmt.Errorf("%w %s", err, config.Compression)
+	}
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := newAccessList(config.Allow, config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	if config.Proxy || len(config.TrustedProxies) > 0 {
+		log.Warn("PROXY protocol is not supported by the tls listener, ignored")
+	}
+	server := &TLSServer{
+		lineHandler: newLineHandler("tls", &config.ListenerConfig, stats, bus),
+		addr:        fmt.Sprintf(":%d", config.Port),
+		config:      config,
+		reloader:    reloader,
+		acl:         acl,
+	}
+	if config.IdleTimeout != "" {
+		server.idle = ParseDurationWithFallback(config.IdleTimeout, 0)
+	}
+	return server, nil
+}
@@ -0,0 +1,58 @@
+// unix
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// removeStaleSocket makes the path free for a new listener, gnet removes
+// whatever is there unconditionally, so refuse to start when the path is not
+// a socket or another process still accepts connections on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// NewUnixServer is a plaintext listener on a unix domain socket
+func NewUnixServer(config *UnixListenerConfig, endpoint *EndpointConfig, stats *Stats, bus *Bus) (*GosheniteServer, error) {
+	if config.Path == "" {
+		return nil, errors.New("unix socket path is not set")
+	}
+	// gnet lowercases the whole listen address
+	if config.Path != strings.ToLower(config.Path) {
+		return nil, fmt.Errorf("unix socket path %s must be lowercase", config.Path)
+	}
+	mode := uint64(0660)
+	if config.Mode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(config.Mode, 8, 32); err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid unix socket mode %s", config.Mode)
+		}
+	}
+	server := NewGosheniteServer("unix", "plain", "unix", &config.ListenerConfig, endpoint, stats, bus)
+	server.addr = "unix://" + config.Path
+	server.socketPath = config.Path
+	server.socketMode = os.FileMode(mode)
+	// a listener per event loop would remove each other's socket file
+	server.reuseport = false
+	return server, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnixServerSocketMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		expected os.FileMode
+	}{
+		{"default", "", 0660},
+		{"owner only", "0600", 0600},
+		{"everyone", "0666", 0666},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// gnet lowercases the address, TempDir has the test name in it
+			dir, err := os.MkdirTemp("", "goshenite")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "plain.sock")
+			config := &UnixListenerConfig{Path: path, Mode: test.mode}
+			server, err := NewUnixServer(config, &EndpointConfig{}, NewStats(&StatsConfig{}, "test"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			umask := syscall.Umask(0022)
+			syscall.Umask(umask)
+			go server.Start()
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				conn, err := net.Dial("unix", path)
+				if err == nil {
+					conn.Close()
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			// OnBoot follows the bind
+			time.Sleep(100 * time.Millisecond)
+			defer server.Shutdown(context.Background())
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != test.expected {
+				t.Errorf("got mode %o, expected %o", mode, test.expected)
+			}
+			if restored := syscall.Umask(umask); restored != umask {
+				t.Errorf("umask %o is not restored, got %o", umask, restored)
+			}
+		})
+	}
+}
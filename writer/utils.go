@@ -4,6 +4,7 @@ package main
 import (
 	"time"
 
+	"github.com/panjf2000/gnet/v2"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,3 +16,18 @@ func ParseDurationWithFallback(s string, fallback time.Duration) time.Duration {
 	}
 	return d
 }
+
+// GnetReadBufferCap mirrors how gnet rounds up the configured ReadBufferCap
+func GnetReadBufferCap(size int) int {
+	switch {
+	case size <= 0:
+		return gnet.MaxStreamBufferCap
+	case size <= 1024:
+		return 1024
+	}
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return n
+}